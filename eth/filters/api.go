@@ -230,18 +230,30 @@ func (api *PublicFilterAPI) NewHeads(ctx context.Context) (*rpc.Subscription, er
 	return rpcSub, nil
 }
 
-func (api *PublicFilterAPI) NewStateChanges(ctx context.Context, crit FilterCriteria) (*rpc.Subscription, error) {
+// NewStateChanges creates a subscription that sends the state diff of each new
+// block, restricted to the accounts matching the given criteria. Payloads with
+// IsReorg set revert the previously sent diffs of the listed blocks and must be
+// handled before applying any subsequent diff.
+func (api *PublicFilterAPI) NewStateChanges(ctx context.Context, crit FilterCriteria, opts *StateChangeOptions) (*rpc.Subscription, error) {
 	notifier, supported := rpc.NotifierFromContext(ctx)
 	if !supported {
 		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
 	}
 
-	rpcSub := notifier.CreateSubscription()
+	var (
+		rpcSub       = notifier.CreateSubscription()
+		stateChanges = make(chan Payload)
+	)
 
-	go func() {
-		stateChanges := make(chan Payload)
-		stateChangeSub := api.events.SubscribeStateChanges(ethereum.FilterQuery(crit), stateChanges)
+	if opts == nil {
+		opts = new(StateChangeOptions)
+	}
+	stateChangeSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery(crit), *opts, stateChanges)
+	if err != nil {
+		return nil, err
+	}
 
+	go func() {
 		for {
 			select {
 			case s := <-stateChanges:
@@ -259,6 +271,24 @@ func (api *PublicFilterAPI) NewStateChanges(ctx context.Context, crit FilterCrit
 	return rpcSub, nil
 }
 
+// GetRecentPayloads returns the state diffs of up to count of the most recent
+// blocks, restricted to the accounts matching the given criteria, oldest first.
+// It allows a client to catch up before subscribing to new state changes. Only
+// the last 16 blocks are kept, and none in light mode.
+func (api *PublicFilterAPI) GetRecentPayloads(ctx context.Context, crit FilterCriteria, count int) ([]Payload, error) {
+	if count > stateChangeRecentEvents {
+		count = stateChangeRecentEvents
+	}
+	payloads, err := api.events.RecentStateChanges(ctx, ethereum.FilterQuery(crit), count)
+	if err != nil {
+		return nil, err
+	}
+	if payloads == nil {
+		return []Payload{}, nil
+	}
+	return payloads, nil
+}
+
 // Logs creates a subscription that fires for all new log that match the given filter criteria.
 func (api *PublicFilterAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc.Subscription, error) {
 	notifier, supported := rpc.NotifierFromContext(ctx)
@@ -19,8 +19,11 @@
 package filters
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,10 +31,13 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rpc"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 // Type determines the kind of filter and is used to put the filter in to
@@ -70,8 +76,19 @@ const (
 	chainEvChanSize = 10
 	// stateChangeChanSize is the size of the channel listening to StateChangeEvent.
 	stateChangeChanSize = 10
+	// maxStateChangePanics is the number of times processing the state changes of
+	// a block may panic before the block is quarantined and no longer processed.
+	maxStateChangePanics = 3
+	// stateChangeReorgDepth is the number of most recent canonical blocks tracked
+	// to detect reorgs reverting previously delivered state diffs.
+	stateChangeReorgDepth = 128
+	// stateChangeRecentEvents is the number of most recent state change events
+	// kept to catch up new subscriptions.
+	stateChangeRecentEvents = 16
 )
 
+var stateChangePanicMeter = metrics.NewRegisteredMeter("eth/filters/statechanges/panics", nil)
+
 type subscription struct {
 	id                  rpc.ID
 	typ                 Type
@@ -81,6 +98,7 @@ type subscription struct {
 	hashes              chan []common.Hash
 	headers             chan *types.Header
 	stateChangePayloads chan Payload
+	stateChangeOpts     StateChangeOptions
 	installed           chan struct{} // closed when the filter is installed
 	err                 chan error    // closed when the filter is uninstalled
 }
@@ -92,6 +110,17 @@ type EventSystem struct {
 	lightMode bool
 	lastHead  *types.Header
 
+	// State change blocks whose canonical status is not yet known
+	pendingStateChanges map[common.Hash]*pendingStateChange
+	// Number of panics while processing the state changes of recent blocks
+	stateChangePanics *lru.Cache
+	// Most recent canonical blocks, used to detect reverted state changes
+	canonicalBlocks *blockRing
+	// Most recent state change events, oldest first
+	recentStateChanges []core.StateChangeEvent
+	// Metadata annotations set on every state change payload
+	stateChangeMetadata map[string]string
+
 	// Subscriptions
 	txsSub              event.Subscription // Subscription for new transaction event
 	logsSub             event.Subscription // Subscription for new log event
@@ -101,14 +130,15 @@ type EventSystem struct {
 	stateChangeEventSub event.Subscription // Subscription for new state change event
 
 	// Channels
-	install              chan *subscription         // install filter for event notification
-	uninstall            chan *subscription         // remove filter for event notification
-	txsCh                chan core.NewTxsEvent      // Channel to receive new transactions event
-	logsCh               chan []*types.Log          // Channel to receive new log event
-	pendingLogsCh        chan []*types.Log          // Channel to receive new log event
-	rmLogsCh             chan core.RemovedLogsEvent // Channel to receive removed log event
-	chainCh              chan core.ChainEvent       // Channel to receive new chain event
-	stateChangeEventChan chan core.StateChangeEvent // Channel to receive new state change event
+	install              chan *subscription              // install filter for event notification
+	uninstall            chan *subscription              // remove filter for event notification
+	txsCh                chan core.NewTxsEvent           // Channel to receive new transactions event
+	logsCh               chan []*types.Log               // Channel to receive new log event
+	pendingLogsCh        chan []*types.Log               // Channel to receive new log event
+	rmLogsCh             chan core.RemovedLogsEvent      // Channel to receive removed log event
+	chainCh              chan core.ChainEvent            // Channel to receive new chain event
+	stateChangeEventChan chan core.StateChangeEvent      // Channel to receive new state change event
+	recentStateChangesCh chan *recentStateChangesRequest // Channel to receive recent state change requests
 }
 
 // NewEventSystem creates a new manager that listens for event on the given mux,
@@ -129,8 +159,14 @@ func NewEventSystem(backend Backend, lightMode bool) *EventSystem {
 		pendingLogsCh:        make(chan []*types.Log, logsChanSize),
 		chainCh:              make(chan core.ChainEvent, chainEvChanSize),
 		stateChangeEventChan: make(chan core.StateChangeEvent, stateChangeChanSize),
+		recentStateChangesCh: make(chan *recentStateChangesRequest),
+		pendingStateChanges:  make(map[common.Hash]*pendingStateChange),
+		canonicalBlocks:      newBlockRing(stateChangeReorgDepth),
+		stateChangeMetadata:  payloadMetadata(backend),
 	}
 
+	m.stateChangePanics, _ = lru.New(stateChangeReorgDepth)
+
 	// Subscribe events
 	m.txsSub = m.backend.SubscribeNewTxsEvent(m.txsCh)
 	m.logsSub = m.backend.SubscribeLogsEvent(m.logsCh)
@@ -322,8 +358,12 @@ func (es *EventSystem) SubscribePendingTxs(hashes chan []common.Hash) *Subscript
 }
 
 // SubscribeStateChanges creates a subscription that writes new state changes that are identified
-// for each new block.
-func (es *EventSystem) SubscribeStateChanges(crit ethereum.FilterQuery, stateChanges chan Payload) *Subscription {
+// for each new block. In light mode only the accounts of the given addresses can be
+// tracked, so a subscription without addresses is rejected.
+func (es *EventSystem) SubscribeStateChanges(crit ethereum.FilterQuery, opts StateChangeOptions, stateChanges chan Payload) (*Subscription, error) {
+	if es.lightMode && len(crit.Addresses) == 0 {
+		return nil, errLightStateChangesNoAddresses
+	}
 	sub := &subscription{
 		id:                  rpc.NewID(),
 		typ:                 StateChangeSubscription,
@@ -333,10 +373,11 @@ func (es *EventSystem) SubscribeStateChanges(crit ethereum.FilterQuery, stateCha
 		hashes:              make(chan []common.Hash),
 		headers:             make(chan *types.Header),
 		stateChangePayloads: stateChanges,
+		stateChangeOpts:     opts,
 		installed:           make(chan struct{}),
 		err:                 make(chan error),
 	}
-	return es.subscribe(sub)
+	return es.subscribe(sub), nil
 }
 
 type filterIndex map[Type]map[rpc.ID]*subscription
@@ -397,9 +438,57 @@ func (es *EventSystem) handleChainEvent(filters filterIndex, ev core.ChainEvent)
 			}
 		})
 	}
+	// Announce reorgs before delivering any diff of the new head
+	es.trackCanonicalBlock(filters, ev.Block)
+	if es.lightMode && len(filters[StateChangeSubscription]) > 0 {
+		es.lightHandleStateChanges(filters, ev.Block)
+	}
+	if len(es.pendingStateChanges) > 0 {
+		es.resolvePendingStateChanges(filters, ev.Block.NumberU64())
+	}
 }
 
 func (es *EventSystem) handleStateChangeEvent(filters filterIndex, ev core.StateChangeEvent) {
+	if ev.Block == nil {
+		log.Warn("Dropping state change event without block")
+		return
+	}
+	hash := ev.Block.Hash()
+	if es.stateChangePanicCount(hash) >= maxStateChangePanics {
+		log.Debug("Skipping state changes of quarantined block", "hash", hash)
+		return
+	}
+	// A malformed event must not bring down the event loop, recover and carry on
+	// with the next one instead.
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+
+			panics := es.stateChangePanicCount(hash) + 1
+			es.stateChangePanics.Add(hash, panics)
+			stateChangePanicMeter.Mark(1)
+			log.Error("State change processing crashed", "hash", hash, "panics", panics, "err", fmt.Sprintf("%v\n%s", err, buf))
+			if panics >= maxStateChangePanics {
+				log.Error("Quarantined block after repeated state change processing crashes", "hash", hash)
+			}
+		}
+	}()
+	var (
+		status  = es.blockStatus(hash, ev.Block.NumberU64())
+		pending *pendingStateChange
+	)
+	if status == PendingBlock {
+		pending = &pendingStateChange{number: ev.Block.NumberU64(), payloads: make(map[rpc.ID]Payload)}
+	} else {
+		es.trackCanonicalBlock(filters, ev.Block)
+		// The block may have become canonical before the chain event settling its
+		// pending ancestors was handled, deliver those first to preserve order.
+		if len(es.pendingStateChanges) > 0 && ev.Block.NumberU64() > 0 {
+			es.resolvePendingStateChanges(filters, ev.Block.NumberU64()-1)
+		}
+	}
 	for _, f := range filters[StateChangeSubscription] {
 		payload, processingErr := processStateChanges(ev, f.filterCrit)
 		if processingErr != nil {
@@ -408,7 +497,375 @@ func (es *EventSystem) handleStateChangeEvent(filters filterIndex, ev core.State
 
 		empty := isPayloadEmpty(payload)
 		if !empty {
-			f.stateChangePayloads <- payload
+			payload.Status = status
+			if pending != nil {
+				pending.payloads[f.id] = payload
+				if f.stateChangeOpts.SkipSideChain {
+					// Withhold the payload until the block is known to be canonical
+					continue
+				}
+			}
+			es.sendStateChange(f, payload)
+		}
+	}
+	if pending != nil && len(pending.payloads) > 0 {
+		es.pendingStateChanges[hash] = pending
+	}
+	if len(es.recentStateChanges) == stateChangeRecentEvents {
+		copy(es.recentStateChanges, es.recentStateChanges[1:])
+		es.recentStateChanges = es.recentStateChanges[:stateChangeRecentEvents-1]
+	}
+	es.recentStateChanges = append(es.recentStateChanges, ev)
+}
+
+// recentStateChangePayloads builds the payloads of up to count of the most recent
+// blocks matching the given criteria, oldest first. Blocks whose canonical status
+// is not yet known are tagged as pending, while blocks already settled as side
+// chain blocks are skipped.
+func (es *EventSystem) recentStateChangePayloads(crit ethereum.FilterQuery, count int) []Payload {
+	tip, tracked := es.canonicalBlocks.last()
+
+	var payloads []Payload
+	for i := len(es.recentStateChanges) - 1; i >= 0 && len(payloads) < count; i-- {
+		var (
+			ev     = es.recentStateChanges[i]
+			hash   = ev.Block.Hash()
+			number = ev.Block.NumberU64()
+			status = es.blockStatus(hash, number)
+		)
+		if status == PendingBlock && es.pendingStateChanges[hash] == nil && tracked && number <= tip.number {
+			// Settled as a side chain block already
+			continue
+		}
+		payload, err := processStateChanges(ev, crit)
+		if err != nil {
+			log.Error("Failed to build recent state diff", "number", ev.Block.Number(), "hash", hash, "err", err)
+			continue
+		}
+		if !isPayloadEmpty(payload) {
+			payload.Status = status
+			payloads = append(payloads, payload)
+		}
+	}
+	for i, j := 0, len(payloads)-1; i < j; i, j = i+1, j-1 {
+		payloads[i], payloads[j] = payloads[j], payloads[i]
+	}
+	return payloads
+}
+
+// sendRecentStateChanges delivers the payloads of up to opts.SendRecent of the
+// most recent blocks matching the criteria of a new subscription, oldest first.
+// The subscription is registered to receive the confirmation of the blocks sent
+// as pending.
+func (es *EventSystem) sendRecentStateChanges(f *subscription) {
+	for _, payload := range es.recentStateChangePayloads(f.filterCrit, f.stateChangeOpts.SendRecent) {
+		if payload.Status == PendingBlock {
+			pending := es.pendingStateChanges[payload.BlockHash]
+			if pending == nil {
+				pending = &pendingStateChange{number: payload.BlockNumber, payloads: make(map[rpc.ID]Payload)}
+				es.pendingStateChanges[payload.BlockHash] = pending
+			}
+			pending.payloads[f.id] = payload
+			if f.stateChangeOpts.SkipSideChain {
+				// Withhold the payload until the block is known to be canonical
+				continue
+			}
+		}
+		es.sendStateChange(f, payload)
+	}
+}
+
+// RecentStateChanges returns the payloads of up to count of the most recent
+// blocks matching the given criteria, oldest first.
+func (es *EventSystem) RecentStateChanges(ctx context.Context, crit ethereum.FilterQuery, count int) ([]Payload, error) {
+	req := &recentStateChangesRequest{crit: crit, count: count, result: make(chan []Payload, 1)}
+	select {
+	case es.recentStateChangesCh <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case payloads := <-req.result:
+		return payloads, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// recentStateChangesRequest asks the event loop for the payloads of the most
+// recent state change events.
+type recentStateChangesRequest struct {
+	crit   ethereum.FilterQuery
+	count  int
+	result chan []Payload
+}
+
+// handleRecentStateChanges answers a request for the most recent payloads.
+func (es *EventSystem) handleRecentStateChanges(req *recentStateChangesRequest) {
+	payloads := es.recentStateChangePayloads(req.crit, req.count)
+	for i := range payloads {
+		es.annotateStateChange(&payloads[i])
+	}
+	req.result <- payloads
+}
+
+// stateChangePanicCount returns the number of times processing the state changes
+// of the given block panicked.
+func (es *EventSystem) stateChangePanicCount(hash common.Hash) int {
+	if panics, ok := es.stateChangePanics.Get(hash); ok {
+		return panics.(int)
+	}
+	return 0
+}
+
+// annotateStateChange sets the metadata of the event system on the payload.
+func (es *EventSystem) annotateStateChange(payload *Payload) {
+	payload.Metadata = make(map[string]string, len(es.stateChangeMetadata))
+	for k, v := range es.stateChangeMetadata {
+		payload.Metadata[k] = v
+	}
+}
+
+// sendStateChange annotates the payload with the metadata of the event system
+// and delivers it to the given subscription.
+func (es *EventSystem) sendStateChange(f *subscription, payload Payload) {
+	es.annotateStateChange(&payload)
+	f.stateChangePayloads <- payload
+}
+
+// pendingStateChange tracks the payloads sent (or withheld) for a block whose
+// canonical status was not yet known when its state changes were processed.
+type pendingStateChange struct {
+	number   uint64
+	payloads map[rpc.ID]Payload
+}
+
+// blockStatus reports whether the given block is part of the canonical chain.
+func (es *EventSystem) blockStatus(hash common.Hash, number uint64) BlockStatus {
+	if rawdb.ReadCanonicalHash(es.backend.ChainDb(), number) == hash {
+		return CanonicalBlock
+	}
+	return PendingBlock
+}
+
+// resolvePendingStateChanges settles the status of all pending blocks up to the
+// given canonical head. Subscribers which received a pending payload are sent a
+// confirmation, while withheld payloads are delivered only if the block became
+// canonical.
+func (es *EventSystem) resolvePendingStateChanges(filters filterIndex, head uint64) {
+	type resolved struct {
+		hash    common.Hash
+		pending *pendingStateChange
+		status  BlockStatus
+	}
+	var settled []resolved
+	for hash, pending := range es.pendingStateChanges {
+		status := es.blockStatus(hash, pending.number)
+		if status == PendingBlock {
+			if pending.number > head {
+				continue
+			}
+			status = SideBlock
+		}
+		delete(es.pendingStateChanges, hash)
+		settled = append(settled, resolved{hash, pending, status})
+	}
+	// Deliver in chain order, diffs applied out of order would corrupt the state
+	sort.Slice(settled, func(i, j int) bool {
+		if settled[i].pending.number != settled[j].pending.number {
+			return settled[i].pending.number < settled[j].pending.number
+		}
+		return bytes.Compare(settled[i].hash[:], settled[j].hash[:]) < 0
+	})
+	for _, r := range settled {
+		hash, pending, status := r.hash, r.pending, r.status
+		confirmation, err := stateChangeConfirmation(hash, pending.number, status)
+		if err != nil {
+			log.Error("Failed to encode state change confirmation", "hash", hash, "err", err)
+			continue
+		}
+		for id, payload := range pending.payloads {
+			f := filters[StateChangeSubscription][id]
+			if f == nil {
+				continue
+			}
+			if !f.stateChangeOpts.SkipSideChain {
+				es.sendStateChange(f, confirmation)
+			} else if status == CanonicalBlock {
+				payload.Status = CanonicalBlock
+				es.sendStateChange(f, payload)
+			}
+		}
+	}
+}
+
+// trackCanonicalBlock records a new canonical block. If the block doesn't extend
+// the previously tracked one, the common ancestor is looked up and all tracked
+// blocks after it are reported to the state change subscribers as reverted in a
+// single reorg payload.
+// Blocks are tracked both on chain events and when their state changes are
+// processed, whichever comes first, so that the reorg is always delivered before
+// the diffs of the new canonical chain.
+func (es *EventSystem) trackCanonicalBlock(filters filterIndex, block *types.Block) {
+	if es.canonicalBlocks.contains(blockRef{hash: block.Hash(), number: block.NumberU64()}) {
+		return
+	}
+	tip, ok := es.canonicalBlocks.last()
+	if !ok || block.ParentHash() == tip.hash {
+		es.canonicalBlocks.push(blockRef{hash: block.Hash(), number: block.NumberU64()})
+		return
+	}
+	// Walk the new chain back until it reaches a tracked block
+	var (
+		newChain []blockRef
+		header   = block.Header()
+		ancestor *blockRef
+	)
+	for header != nil && len(newChain) <= stateChangeReorgDepth {
+		ref := blockRef{hash: header.Hash(), number: header.Number.Uint64()}
+		if es.canonicalBlocks.contains(ref) {
+			ancestor = &ref
+			break
+		}
+		newChain = append(newChain, ref)
+		if ref.number == 0 {
+			break
+		}
+		header = rawdb.ReadHeader(es.backend.ChainDb(), header.ParentHash, ref.number-1)
+	}
+	if ancestor == nil {
+		if es.blockStatus(tip.hash, tip.number) == CanonicalBlock {
+			if block.NumberU64() <= tip.number {
+				// Late ancestor of the tracked chain, nothing to do
+				return
+			}
+			log.Debug("No common ancestor with tracked canonical blocks", "number", block.Number(), "hash", block.Hash())
+		} else {
+			log.Warn("Chain reorganised beyond tracked blocks, reorg not announced", "number", block.Number(), "hash", block.Hash(), "tip", tip.number)
+		}
+		es.canonicalBlocks.reset()
+	} else if reverted := es.canonicalBlocks.truncate(ancestor.number); len(reverted) > 0 {
+		hashes := make([]common.Hash, len(reverted))
+		for i, ref := range reverted {
+			hashes[i] = ref.hash
+		}
+		if reorg, err := stateChangeReorg(ancestor.hash, ancestor.number, hashes); err != nil {
+			log.Error("Failed to encode state change reorg", "hash", ancestor.hash, "err", err)
+		} else {
+			for _, f := range filters[StateChangeSubscription] {
+				es.sendStateChange(f, reorg)
+			}
+		}
+	}
+	for i := len(newChain) - 1; i >= 0; i-- {
+		es.canonicalBlocks.push(newChain[i])
+	}
+}
+
+// blockRef identifies a block by hash and number.
+type blockRef struct {
+	hash   common.Hash
+	number uint64
+}
+
+// blockRing is a fixed size circular buffer of the most recent canonical blocks,
+// ordered by ascending block number.
+type blockRing struct {
+	blocks []blockRef
+	head   int // index of the next slot to write
+	size   int // number of tracked blocks
+}
+
+func newBlockRing(capacity int) *blockRing {
+	return &blockRing{blocks: make([]blockRef, capacity)}
+}
+
+// push adds a block, overwriting the oldest one if the ring is full.
+func (r *blockRing) push(ref blockRef) {
+	r.blocks[r.head] = ref
+	r.head = (r.head + 1) % len(r.blocks)
+	if r.size < len(r.blocks) {
+		r.size++
+	}
+}
+
+// at returns the i-th most recent block, starting at 0.
+func (r *blockRing) at(i int) blockRef {
+	return r.blocks[(r.head-1-i+2*len(r.blocks))%len(r.blocks)]
+}
+
+// last returns the most recent block, if any.
+func (r *blockRing) last() (blockRef, bool) {
+	if r.size == 0 {
+		return blockRef{}, false
+	}
+	return r.at(0), true
+}
+
+// contains reports whether the given block is tracked.
+func (r *blockRing) contains(ref blockRef) bool {
+	for i := 0; i < r.size; i++ {
+		if r.at(i) == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate removes all blocks above the given number, returning them most
+// recent first.
+func (r *blockRing) truncate(number uint64) []blockRef {
+	var removed []blockRef
+	for r.size > 0 && r.at(0).number > number {
+		removed = append(removed, r.at(0))
+		r.head = (r.head - 1 + len(r.blocks)) % len(r.blocks)
+		r.size--
+	}
+	return removed
+}
+
+// reset removes all tracked blocks.
+func (r *blockRing) reset() {
+	r.head, r.size = 0, 0
+}
+
+// lightHandleStateChanges builds the state diffs of the watched addresses for a
+// new block in light client mode. The accounts watched by all subscriptions are
+// retrieved at once and the diff of each subscription is built from them.
+// Failing to retrieve or verify the state of the block results in an error
+// payload instead of a (possibly incorrect) diff.
+func (es *EventSystem) lightHandleStateChanges(filters filterIndex, block *types.Block) {
+	var (
+		addresses    []common.Address
+		seen         = make(map[common.Address]struct{})
+		stateChanges state.StateChanges
+		err          = errLightStateUnavailable
+	)
+	for _, f := range filters[StateChangeSubscription] {
+		for _, addr := range f.filterCrit.Addresses {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+	if backend, ok := es.backend.(lightStateBackend); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		stateChanges, err = lightStateChanges(ctx, backend, block.Header(), addresses)
+		cancel()
+	}
+	for _, f := range filters[StateChangeSubscription] {
+		payload, processingErr := Payload{}, err
+		if processingErr == nil {
+			payload, processingErr = processStateChanges(core.StateChangeEvent{Block: block, StateChanges: stateChanges}, f.filterCrit)
+		}
+		if processingErr != nil {
+			log.Debug("Failed to build light state diff", "number", block.Number(), "hash", block.Hash(), "err", processingErr)
+			payload = Payload{BlockNumber: block.NumberU64(), BlockHash: block.Hash(), Err: processingErr.Error()}
+		}
+		if !isPayloadEmpty(payload) {
+			payload.Status = CanonicalBlock
+			es.sendStateChange(f, payload)
 		}
 	}
 }
@@ -517,6 +974,8 @@ func (es *EventSystem) eventLoop() {
 			es.handleChainEvent(index, ev)
 		case ev := <-es.stateChangeEventChan:
 			es.handleStateChangeEvent(index, ev)
+		case req := <-es.recentStateChangesCh:
+			es.handleRecentStateChanges(req)
 
 		case f := <-es.install:
 			if f.typ == MinedAndPendingLogsSubscription {
@@ -527,6 +986,9 @@ func (es *EventSystem) eventLoop() {
 				index[f.typ][f.id] = f
 			}
 			close(f.installed)
+			if f.typ == StateChangeSubscription && f.stateChangeOpts.SendRecent > 0 {
+				es.sendRecentStateChanges(f)
+			}
 
 		case f := <-es.uninstall:
 			if f.typ == MinedAndPendingLogsSubscription {
@@ -19,11 +19,14 @@ package filters
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
 	"reflect"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +38,8 @@ import (
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
@@ -137,6 +142,19 @@ func (b *testBackend) SubscribeStateChangeEvent(ch chan<- core.StateChangeEvent)
 	return b.stateChangeFeed.Subscribe(ch)
 }
 
+func (b *testBackend) StateAndHeaderByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*state.StateDB, *types.Header, error) {
+	hash, ok := blockNrOrHash.Hash()
+	if !ok {
+		return nil, nil, errors.New("only lookups by hash are supported")
+	}
+	header, _ := b.HeaderByHash(ctx, hash)
+	if header == nil {
+		return nil, nil, errors.New("header not found")
+	}
+	statedb, err := state.New(header.Root, state.NewDatabase(b.db), nil)
+	return statedb, header, err
+}
+
 func (b *testBackend) BloomStatus() (uint64, uint64) {
 	return params.BloomBitsBlocks, b.sections
 }
@@ -826,7 +844,10 @@ func TestStateChangeSubscription(t *testing.T) {
 
 	for _, test := range testCases {
 		chan0 := make(chan Payload)
-		sub0 := api.events.SubscribeStateChanges(test.crit, chan0)
+		sub0, err := api.events.SubscribeStateChanges(test.crit, StateChangeOptions{}, chan0)
+		if err != nil {
+			t.Fatalf("failed to subscribe to state changes: %v", err)
+		}
 
 		payloads := make([]Payload, 0, len(test.expectedPayloads))
 		go func() {
@@ -856,6 +877,10 @@ func TestStateChangeSubscription(t *testing.T) {
 		}
 
 		for index, payload := range payloads {
+			if payload.BlockNumber != test.expectedPayloads[index].BlockNumber || payload.BlockHash != test.expectedPayloads[index].BlockHash {
+				t.Errorf("Test failure: %s: %s", t.Name(), test.description)
+				t.Logf("Actual payload block does not equal expected.\nactual: %d %x\nexpected: %d %x", payload.BlockNumber, payload.BlockHash, test.expectedPayloads[index].BlockNumber, test.expectedPayloads[index].BlockHash)
+			}
 			var actualStateDiff, expectedStateDiff StateDiff
 			actualRLP := payload.StateDiffRlp
 			err := rlp.DecodeBytes(actualRLP, &actualStateDiff)
@@ -891,18 +916,19 @@ func TestStateChangeSubscription(t *testing.T) {
 					t.Logf("Actual payload updated account key equal expected.\nactual:%+v\nexpected: %+v", actualUpdatedAccount.Key, e.Key)
 				}
 
-				if !bytes.Equal(actualUpdatedAccount.Value, e.Value) {
+				actualAccountRlp, _ := rlp.EncodeToBytes(actualUpdatedAccount.Account)
+				expectedAccountRlp, _ := rlp.EncodeToBytes(e.Account)
+				if !bytes.Equal(actualAccountRlp, expectedAccountRlp) {
 					t.Errorf("Test failure: %s: %s", t.Name(), test.description)
-					t.Logf("Actual payload updated account value equal expected.\nactual:%+v\nexpected: %+v", actualUpdatedAccount.Value, e.Value)
+					t.Logf("Actual payload updated account equal expected.\nactual:%+v\nexpected: %+v", actualUpdatedAccount.Account, e.Account)
 				}
 
-				// Store storage keys for this updatedAccount in a map to avoid errors from order
-				actualUpdatedStorageDiffs := make(map[string]StorageDiff)
-				for _, storageDiff := range actualUpdatedAccount.Storage {
-					actualUpdatedStorageDiffs[string(storageDiff.Key)] = storageDiff
+				if len(actualUpdatedAccount.Storage) != len(e.Storage) {
+					t.Errorf("Test failure: %s: %s", t.Name(), test.description)
+					t.Logf("Actual payload updated account storage count equal expected.\nactual:%+v\nexpected: %+v", len(actualUpdatedAccount.Storage), len(e.Storage))
 				}
-				for _, se := range e.Storage {
-					actualStorageDiff := actualUpdatedStorageDiffs[string(se.Key)]
+				for key, se := range e.Storage {
+					actualStorageDiff := actualUpdatedAccount.Storage[key]
 
 					if !bytes.Equal(actualStorageDiff.Key, se.Key) {
 						t.Errorf("Test failure: %s: %s", t.Name(), test.description)
@@ -920,13 +946,9 @@ func TestStateChangeSubscription(t *testing.T) {
 }
 
 func getAccountDiff(accountAddress common.Address, modifedAccount state.ModifiedAccount, t *testing.T) AccountDiff {
-	accountRlp, accountRlpErr := rlp.EncodeToBytes(&modifedAccount.StateAccount)
-	if accountRlpErr != nil {
-		t.Error("Test failure:", t.Name())
-		t.Logf("Failed to encode account diff")
-	}
+	account := modifedAccount.StateAccount
 
-	var storageDiffs []StorageDiff
+	storageDiffs := make(map[string]StorageDiff)
 	for key, value := range modifedAccount.Storage {
 		storageValueRlp, storageRlpErr := rlp.EncodeToBytes(value)
 		if storageRlpErr != nil {
@@ -938,12 +960,12 @@ func getAccountDiff(accountAddress common.Address, modifedAccount state.Modified
 			Value: storageValueRlp,
 		}
 
-		storageDiffs = append(storageDiffs, storageDiff)
+		storageDiffs[StorageDiffKey(key[:])] = storageDiff
 	}
 
 	return AccountDiff{
 		Key:     accountAddress[:],
-		Value:   accountRlp,
+		Account: &account,
 		Storage: storageDiffs,
 	}
 }
@@ -962,7 +984,905 @@ func getExpectedPayloads(blocks []*types.Block, updatedAccounts []AccountDiff, t
 			t.Logf("Failed to encode state diff to bytes")
 			return payloads
 		}
-		payloads = append(payloads, Payload{StateDiffRlp: expectedStateDiffRLP})
+		payloads = append(payloads, Payload{BlockNumber: block.NumberU64(), BlockHash: block.Hash(), StateDiffRlp: expectedStateDiffRLP})
 	}
 	return payloads
 }
+
+// countingStateBackend is a testBackend counting its state retrievals.
+type countingStateBackend struct {
+	*testBackend
+	retrievals int32
+}
+
+func (b *countingStateBackend) StateAndHeaderByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*state.StateDB, *types.Header, error) {
+	atomic.AddInt32(&b.retrievals, 1)
+	return b.testBackend.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+}
+
+// lightStateChangeTest is a light client event system over a chain whose blocks
+// transfer value from a funded sender, all written to the database.
+type lightStateChangeTest struct {
+	db      ethdb.Database
+	backend *countingStateBackend
+	events  *EventSystem
+	key     *ecdsa.PrivateKey
+	genesis *types.Block
+	chain   []*types.Block
+}
+
+// lightStateChangeGen configures the i-th generated block, transfer adds a value
+// transfer from the funded sender to the given account.
+type lightStateChangeGen func(i int, block *core.BlockGen, transfer func(to common.Address))
+
+// newLightStateChangeTest creates a light client event system over a chain of the
+// given number of blocks built by gen.
+func newLightStateChangeTest(blocks int, gen lightStateChangeGen) *lightStateChangeTest {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		key, _ = crypto.GenerateKey()
+	)
+	lt := &lightStateChangeTest{
+		db:      db,
+		backend: &countingStateBackend{testBackend: &testBackend{db: db}},
+		key:     key,
+		genesis: (&core.Genesis{
+			Alloc:   core.GenesisAlloc{crypto.PubkeyToAddress(key.PublicKey): {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}).MustCommit(db),
+	}
+	lt.events = NewEventSystem(lt.backend, true)
+	lt.chain = lt.generate(lt.genesis, blocks, gen)
+	return lt
+}
+
+// generate builds and writes the given number of blocks on top of parent.
+func (lt *lightStateChangeTest) generate(parent *types.Block, blocks int, gen lightStateChangeGen) []*types.Block {
+	var (
+		sender = crypto.PubkeyToAddress(lt.key.PublicKey)
+		signer = types.LatestSigner(params.TestChainConfig)
+	)
+	chain, _ := core.GenerateChain(params.TestChainConfig, parent, ethash.NewFaker(), lt.db, blocks, func(i int, block *core.BlockGen) {
+		gen(i, block, func(to common.Address) {
+			tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(sender), to, big.NewInt(1000), params.TxGas, block.BaseFee(), nil), signer, lt.key)
+			block.AddTx(tx)
+		})
+	})
+	for _, block := range chain {
+		rawdb.WriteBlock(lt.db, block)
+	}
+	return chain
+}
+
+// TestLightStateChangeSubscription tests that in light mode state changes of the
+// watched addresses are reconstructed from the pre- and post-block state, and that
+// subscriptions without a watch list are rejected.
+func TestLightStateChangeSubscription(t *testing.T) {
+	t.Parallel()
+
+	var (
+		receiver = common.HexToAddress("0xdeadbeef")
+		idle     = common.HexToAddress("0xcafebabe")
+		lt       = newLightStateChangeTest(1, func(i int, block *core.BlockGen, transfer func(common.Address)) {
+			transfer(receiver)
+		})
+	)
+	if _, err := lt.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, make(chan Payload)); err != errLightStateChangesNoAddresses {
+		t.Fatalf("unexpected error for subscription without addresses: have %v, want %v", err, errLightStateChangesNoAddresses)
+	}
+	payloads := make(chan Payload)
+	sub, err := lt.events.SubscribeStateChanges(ethereum.FilterQuery{Addresses: []common.Address{receiver, idle}}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	lt.backend.chainFeed.Send(core.ChainEvent{Block: lt.chain[0], Hash: lt.chain[0].Hash()})
+
+	select {
+	case payload := <-payloads:
+		if payload.Err != "" {
+			t.Fatalf("unexpected error payload: %v", payload.Err)
+		}
+		var stateDiff StateDiff
+		if err := rlp.DecodeBytes(payload.StateDiffRlp, &stateDiff); err != nil {
+			t.Fatalf("failed to decode state diff: %v", err)
+		}
+		if len(stateDiff.UpdatedAccounts) != 1 {
+			t.Fatalf("updated account count mismatch: have %d, want 1", len(stateDiff.UpdatedAccounts))
+		}
+		if have := common.BytesToAddress(stateDiff.UpdatedAccounts[0].Key); have != receiver {
+			t.Errorf("updated account mismatch: have %x, want %x", have, receiver)
+		}
+		if account := stateDiff.UpdatedAccounts[0].Account; account.Balance.Cmp(big.NewInt(1000)) != 0 {
+			t.Errorf("balance mismatch: have %v, want %v", account.Balance, 1000)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for light state diff")
+	}
+
+	// A block whose state is unavailable must yield an error payload
+	unknown := types.NewBlockWithHeader(&types.Header{ParentHash: lt.chain[0].Hash(), Number: big.NewInt(2)})
+	lt.backend.chainFeed.Send(core.ChainEvent{Block: unknown, Hash: unknown.Hash()})
+
+	select {
+	case payload := <-payloads:
+		if payload.Err == "" || payload.StateDiffRlp != nil {
+			t.Errorf("expected error payload, got %+v", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for error payload")
+	}
+}
+
+// TestLightStateChangeSharedRetrieval tests that in light client mode the state
+// of a new head is retrieved once for all subscriptions.
+func TestLightStateChangeSharedRetrieval(t *testing.T) {
+	t.Parallel()
+
+	var (
+		first  = common.HexToAddress("0xdeadbeef")
+		second = common.HexToAddress("0xcafebabe")
+		lt     = newLightStateChangeTest(1, func(i int, block *core.BlockGen, transfer func(common.Address)) {
+			transfer(first)
+			transfer(second)
+		})
+	)
+	watches := [][]common.Address{{first}, {first, second}, {second}}
+	payloads := make([]chan Payload, len(watches))
+	for i, addresses := range watches {
+		payloads[i] = make(chan Payload, 1)
+		sub, err := lt.events.SubscribeStateChanges(ethereum.FilterQuery{Addresses: addresses}, StateChangeOptions{}, payloads[i])
+		if err != nil {
+			t.Fatalf("failed to subscribe to state changes: %v", err)
+		}
+		defer sub.Unsubscribe()
+	}
+	lt.backend.chainFeed.Send(core.ChainEvent{Block: lt.chain[0], Hash: lt.chain[0].Hash()})
+
+	for i, addresses := range watches {
+		select {
+		case payload := <-payloads[i]:
+			stateDiff, err := DecodeStateDiff(payload)
+			if err != nil {
+				t.Fatalf("subscription %d: failed to decode state diff: %v", i, err)
+			}
+			if stateDiff.AccountCount() != len(addresses) {
+				t.Errorf("subscription %d: account count mismatch: have %d, want %d", i, stateDiff.AccountCount(), len(addresses))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscription %d: timeout waiting for light state diff", i)
+		}
+	}
+	// The parent and the head state, regardless of the number of subscriptions
+	if have := atomic.LoadInt32(&lt.backend.retrievals); have != 2 {
+		t.Errorf("state retrieval count mismatch: have %d, want 2", have)
+	}
+}
+
+// TestLightStateChangeUnchangedAddress tests that in light client mode no payload
+// is delivered for a block leaving all watched addresses unchanged.
+func TestLightStateChangeUnchangedAddress(t *testing.T) {
+	t.Parallel()
+
+	var (
+		watched = common.HexToAddress("0xdeadbeef")
+		other   = common.HexToAddress("0xcafebabe")
+		lt      = newLightStateChangeTest(2, func(i int, block *core.BlockGen, transfer func(common.Address)) {
+			if i == 0 {
+				transfer(other)
+			} else {
+				transfer(watched)
+			}
+		})
+	)
+	payloads := make(chan Payload, 2)
+	sub, err := lt.events.SubscribeStateChanges(ethereum.FilterQuery{Addresses: []common.Address{watched}}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for _, block := range lt.chain {
+		lt.backend.chainFeed.Send(core.ChainEvent{Block: block, Hash: block.Hash()})
+	}
+	// Events are handled in order, the first block must not yield a payload
+	select {
+	case payload := <-payloads:
+		if payload.BlockHash != lt.chain[1].Hash() {
+			t.Fatalf("payload mismatch: have %d %x, want %d %x", payload.BlockNumber, payload.BlockHash, lt.chain[1].NumberU64(), lt.chain[1].Hash())
+		}
+		if _, err := DecodeStateDiff(payload); err != nil {
+			t.Fatalf("failed to decode state diff: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for light state diff")
+	}
+}
+
+// TestLightStateChangeReorg tests that in light client mode a reorg is announced
+// before the state diff of the new head is delivered.
+func TestLightStateChangeReorg(t *testing.T) {
+	t.Parallel()
+
+	var (
+		receiver = common.HexToAddress("0xdeadbeef")
+		lt       = newLightStateChangeTest(3, func(i int, block *core.BlockGen, transfer func(common.Address)) {
+			transfer(receiver)
+		})
+		oldChain = lt.chain
+		// Fork a longer chain off the first block, reverting the last two blocks
+		newChain = lt.generate(oldChain[0], 3, func(i int, block *core.BlockGen, transfer func(common.Address)) {
+			block.SetCoinbase(common.HexToAddress("0xc0ffee"))
+			transfer(receiver)
+		})
+	)
+	payloads := make(chan Payload, 8)
+	sub, err := lt.events.SubscribeStateChanges(ethereum.FilterQuery{Addresses: []common.Address{receiver}}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	next := func() Payload {
+		select {
+		case payload := <-payloads:
+			if payload.Err != "" {
+				t.Fatalf("unexpected error payload: %v", payload.Err)
+			}
+			return payload
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for light state diff")
+		}
+		return Payload{}
+	}
+	for _, block := range oldChain {
+		lt.backend.chainFeed.Send(core.ChainEvent{Block: block, Hash: block.Hash()})
+		if payload := next(); payload.BlockHash != block.Hash() || payload.IsReorg {
+			t.Fatalf("payload mismatch: have %d %x, want %d %x", payload.BlockNumber, payload.BlockHash, block.NumberU64(), block.Hash())
+		}
+	}
+	// The light client only announces the new head
+	head := newChain[len(newChain)-1]
+	lt.backend.chainFeed.Send(core.ChainEvent{Block: head, Hash: head.Hash()})
+
+	reorg := next()
+	if !reorg.IsReorg || reorg.BlockHash != oldChain[0].Hash() {
+		t.Fatalf("reorg mismatch: have %v %d %x, want reorg to %d %x", reorg.IsReorg, reorg.BlockNumber, reorg.BlockHash, oldChain[0].NumberU64(), oldChain[0].Hash())
+	}
+	reverted := []common.Hash{oldChain[2].Hash(), oldChain[1].Hash()}
+	if !reflect.DeepEqual(reorg.RevertedHashes, reverted) {
+		t.Fatalf("reverted hashes mismatch: have %x, want %x", reorg.RevertedHashes, reverted)
+	}
+	if payload := next(); payload.BlockHash != head.Hash() || payload.IsReorg {
+		t.Fatalf("payload mismatch: have %d %x, want %d %x", payload.BlockNumber, payload.BlockHash, head.NumberU64(), head.Hash())
+	}
+}
+
+// testStateChanges returns the state changes of a block crediting the given
+// accounts.
+func testStateChanges(addrs ...common.Address) state.StateChanges {
+	changes := make(state.StateChanges, len(addrs))
+	for _, addr := range addrs {
+		changes[addr] = state.ModifiedAccount{StateAccount: types.StateAccount{Balance: big.NewInt(1)}}
+	}
+	return changes
+}
+
+// TestStateChangeCanonicalStatus tests that payloads of blocks not yet on the
+// canonical chain are tagged as pending and later confirmed as either canonical
+// or side chain, and that side chain payloads can be opted out of.
+func TestStateChangeCanonicalStatus(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 2, func(i int, gen *core.BlockGen) {})
+		forks, _ = core.GenerateChain(params.TestChainConfig, chain[0], ethash.NewFaker(), db, 1, func(i int, gen *core.BlockGen) {
+			gen.SetCoinbase(common.HexToAddress("0xdeadbeef"))
+		})
+		changes = testStateChanges(common.HexToAddress("0x1"))
+	)
+	all, canon := make(chan Payload, 4), make(chan Payload, 4)
+	allSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, all)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer allSub.Unsubscribe()
+	canonSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SkipSideChain: true}, canon)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer canonSub.Unsubscribe()
+
+	expect := func(ch chan Payload, hash common.Hash, status BlockStatus, accounts int) {
+		t.Helper()
+		select {
+		case payload := <-ch:
+			var stateDiff StateDiff
+			if err := rlp.DecodeBytes(payload.StateDiffRlp, &stateDiff); err != nil {
+				t.Fatalf("failed to decode state diff: %v", err)
+			}
+			if stateDiff.BlockHash != hash || payload.BlockHash != hash || payload.Status != status || len(stateDiff.UpdatedAccounts) != accounts {
+				t.Fatalf("payload mismatch: have %x/%s/%d, want %x/%s/%d", stateDiff.BlockHash, payload.Status, len(stateDiff.UpdatedAccounts), hash, status, accounts)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for payload of %x", hash)
+		}
+	}
+	// Block 1 is processed before becoming canonical and is confirmed later on
+	backend.stateChangeFeed.Send(core.StateChangeEvent{Block: chain[0], StateChanges: changes})
+	expect(all, chain[0].Hash(), PendingBlock, 1)
+
+	rawdb.WriteCanonicalHash(db, chain[0].Hash(), 1)
+	backend.chainFeed.Send(core.ChainEvent{Block: chain[0], Hash: chain[0].Hash()})
+	expect(all, chain[0].Hash(), CanonicalBlock, 0)
+	expect(canon, chain[0].Hash(), CanonicalBlock, 1)
+
+	// A competing block 2 is processed, but the other one becomes canonical
+	backend.stateChangeFeed.Send(core.StateChangeEvent{Block: forks[0], StateChanges: changes})
+	expect(all, forks[0].Hash(), PendingBlock, 1)
+
+	rawdb.WriteCanonicalHash(db, chain[1].Hash(), 2)
+	backend.chainFeed.Send(core.ChainEvent{Block: chain[1], Hash: chain[1].Hash()})
+	expect(all, forks[0].Hash(), SideBlock, 0)
+
+	// Blocks already canonical when processed are tagged as such immediately
+	backend.stateChangeFeed.Send(core.StateChangeEvent{Block: chain[1], StateChanges: changes})
+	expect(all, chain[1].Hash(), CanonicalBlock, 1)
+	expect(canon, chain[1].Hash(), CanonicalBlock, 1)
+}
+
+// TestStateChangePendingOrder tests that pending blocks settled by the same chain
+// event are confirmed, or their withheld payloads delivered, in chain order.
+func TestStateChangePendingOrder(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 5, func(i int, gen *core.BlockGen) {})
+		changes  = testStateChanges(common.HexToAddress("0x1"))
+	)
+	all, canon := make(chan Payload, 2*len(chain)), make(chan Payload, len(chain))
+	allSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, all)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer allSub.Unsubscribe()
+	canonSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SkipSideChain: true}, canon)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer canonSub.Unsubscribe()
+
+	expect := func(ch chan Payload, block *types.Block, status BlockStatus) {
+		t.Helper()
+		select {
+		case payload := <-ch:
+			if payload.BlockHash != block.Hash() || payload.Status != status {
+				t.Fatalf("payload mismatch: have %d %x %s, want %d %x %s", payload.BlockNumber, payload.BlockHash, payload.Status, block.NumberU64(), block.Hash(), status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for payload of block %d", block.NumberU64())
+		}
+	}
+	for _, block := range chain {
+		backend.stateChangeFeed.Send(core.StateChangeEvent{Block: block, StateChanges: changes})
+		expect(all, block, PendingBlock)
+	}
+	for _, block := range chain {
+		rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+	}
+	head := chain[len(chain)-1]
+	backend.chainFeed.Send(core.ChainEvent{Block: head, Hash: head.Hash()})
+	for _, block := range chain {
+		expect(all, block, CanonicalBlock)
+		expect(canon, block, CanonicalBlock)
+	}
+}
+
+// TestStateChangeSendRecent tests that new subscriptions can be caught up with
+// the payloads of recent canonical blocks matching their criteria.
+func TestStateChangeSendRecent(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 4, func(i int, gen *core.BlockGen) {})
+		watched  = common.HexToAddress("0x1")
+		other    = common.HexToAddress("0x2")
+	)
+	payloads := make(chan Payload, len(chain))
+	sub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for i, block := range chain {
+		rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		addr := watched
+		if i == 2 {
+			addr = other
+		}
+		backend.stateChangeFeed.Send(core.StateChangeEvent{Block: block, StateChanges: testStateChanges(addr)})
+		select {
+		case <-payloads:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for payload of block %d", block.NumberU64())
+		}
+	}
+	// The block not touching the watched account is skipped
+	recent := make(chan Payload, len(chain))
+	recentSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{Addresses: []common.Address{watched}}, StateChangeOptions{SendRecent: 2}, recent)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer recentSub.Unsubscribe()
+
+	for _, block := range []*types.Block{chain[1], chain[3]} {
+		select {
+		case payload := <-recent:
+			if payload.BlockHash != block.Hash() || payload.Status != CanonicalBlock {
+				t.Fatalf("payload mismatch: have %d %x %s, want %d %x %s", payload.BlockNumber, payload.BlockHash, payload.Status, block.NumberU64(), block.Hash(), CanonicalBlock)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for recent payload of block %d", block.NumberU64())
+		}
+	}
+	select {
+	case payload := <-recent:
+		t.Fatalf("unexpected recent payload of block %d", payload.BlockNumber)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestStateChangeSendRecentPending tests that a subscription catching up while
+// the head is not yet canonical receives the head as pending along with its later
+// confirmation, or only once canonical if it skips side chain payloads.
+func TestStateChangeSendRecentPending(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 2, func(i int, gen *core.BlockGen) {})
+		changes  = testStateChanges(common.HexToAddress("0x1"))
+	)
+	// The parent is canonical, the head is processed before being written as such
+	rawdb.WriteCanonicalHash(db, chain[0].Hash(), chain[0].NumberU64())
+	backend.chainFeed.Send(core.ChainEvent{Block: chain[0], Hash: chain[0].Hash()})
+	for _, block := range chain {
+		backend.stateChangeFeed.Send(core.StateChangeEvent{Block: block, StateChanges: changes})
+	}
+	all, canon := make(chan Payload, 4), make(chan Payload, 4)
+	allSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SendRecent: 2}, all)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer allSub.Unsubscribe()
+	canonSub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SendRecent: 2, SkipSideChain: true}, canon)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer canonSub.Unsubscribe()
+
+	expect := func(ch chan Payload, block *types.Block, status BlockStatus, accounts int) {
+		t.Helper()
+		select {
+		case payload := <-ch:
+			stateDiff, err := DecodeStateDiff(payload)
+			if err != nil {
+				t.Fatalf("failed to decode state diff: %v", err)
+			}
+			if payload.BlockHash != block.Hash() || payload.Status != status || len(stateDiff.UpdatedAccounts) != accounts {
+				t.Fatalf("payload mismatch: have %d %x %s %d, want %d %x %s %d", payload.BlockNumber, payload.BlockHash, payload.Status, len(stateDiff.UpdatedAccounts), block.NumberU64(), block.Hash(), status, accounts)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for payload of block %d", block.NumberU64())
+		}
+	}
+	expect(all, chain[0], CanonicalBlock, 1)
+	expect(all, chain[1], PendingBlock, 1)
+	expect(canon, chain[0], CanonicalBlock, 1)
+
+	rawdb.WriteCanonicalHash(db, chain[1].Hash(), chain[1].NumberU64())
+	backend.chainFeed.Send(core.ChainEvent{Block: chain[1], Hash: chain[1].Hash()})
+	expect(all, chain[1], CanonicalBlock, 0)
+	expect(canon, chain[1], CanonicalBlock, 1)
+}
+
+// TestGetRecentPayloads tests that the payloads of the most recent blocks can be
+// retrieved without subscribing.
+func TestGetRecentPayloads(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 4, func(i int, gen *core.BlockGen) {})
+		watched  = common.HexToAddress("0x1")
+		other    = common.HexToAddress("0x2")
+	)
+	// The last block touches another account and isn't canonical yet
+	for i, block := range chain {
+		if i < 3 {
+			rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		}
+		addr := watched
+		if i == 2 {
+			addr = other
+		}
+		backend.stateChangeFeed.Send(core.StateChangeEvent{Block: block, StateChanges: testStateChanges(addr)})
+	}
+	tests := []struct {
+		crit  FilterCriteria
+		count int
+		want  []*types.Block
+	}{
+		{FilterCriteria{}, 0, nil},
+		{FilterCriteria{}, 2, chain[2:]},
+		{FilterCriteria{Addresses: []common.Address{watched}}, 2, []*types.Block{chain[1], chain[3]}},
+		{FilterCriteria{Addresses: []common.Address{watched}}, 100, []*types.Block{chain[0], chain[1], chain[3]}},
+	}
+	for i, tt := range tests {
+		payloads, err := api.GetRecentPayloads(context.Background(), tt.crit, tt.count)
+		if err != nil {
+			t.Fatalf("test %d: failed to get recent payloads: %v", i, err)
+		}
+		if len(payloads) != len(tt.want) {
+			t.Fatalf("test %d: payload count mismatch: have %d, want %d", i, len(payloads), len(tt.want))
+		}
+		for j, block := range tt.want {
+			want := CanonicalBlock
+			if block == chain[3] {
+				want = PendingBlock
+			}
+			if payloads[j].BlockHash != block.Hash() || payloads[j].Status != want {
+				t.Errorf("test %d, payload %d: mismatch: have %d %x %s, want %d %x %s", i, j, payloads[j].BlockNumber, payloads[j].BlockHash, payloads[j].Status, block.NumberU64(), block.Hash(), want)
+			}
+		}
+	}
+}
+
+// TestStateChangePanicRecovery tests that a state change event crashing the
+// processing does not stop the event loop, and that a block crashing it
+// repeatedly is quarantined.
+func TestStateChangePanicRecovery(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		backend  = &testBackend{db: db}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		genesis  = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chain, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 1, func(i int, gen *core.BlockGen) {})
+		changes  = testStateChanges(common.HexToAddress("0x1"))
+
+		// A block without header panics on any access to its fields
+		malformed = new(types.Block)
+	)
+	payloads := make(chan Payload)
+	sub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for i := 0; i < maxStateChangePanics+1; i++ {
+		backend.stateChangeFeed.Send(core.StateChangeEvent{Block: malformed, StateChanges: changes})
+	}
+	backend.stateChangeFeed.Send(core.StateChangeEvent{Block: chain[0], StateChanges: changes})
+
+	select {
+	case payload := <-payloads:
+		if payload.BlockHash != chain[0].Hash() {
+			t.Fatalf("payload block mismatch: have %x, want %x", payload.BlockHash, chain[0].Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event loop stopped after state change processing crash")
+	}
+	// All earlier events were handled before the payload was delivered
+	if have := api.events.stateChangePanicCount(malformed.Hash()); have != maxStateChangePanics {
+		t.Errorf("panic count mismatch: have %d, want %d", have, maxStateChangePanics)
+	}
+}
+
+// chainBackend is a testBackend which sources chain and state change events
+// from an actual blockchain.
+type chainBackend struct {
+	*testBackend
+	chain *core.BlockChain
+}
+
+func (b *chainBackend) SubscribeChainEvent(ch chan<- core.ChainEvent) event.Subscription {
+	return b.chain.SubscribeChainEvent(ch)
+}
+
+func (b *chainBackend) ChainConfig() *params.ChainConfig {
+	return b.chain.Config()
+}
+
+func (b *chainBackend) SubscribeStateChangeEvent(ch chan<- core.StateChangeEvent) event.Subscription {
+	return b.chain.SubscribeStateChangeEvent(ch)
+}
+
+// TestStateChangeBlockChain tests the state diffs delivered to subscribers while
+// importing a chain with value transfers and contract deployments against the
+// state actually committed by the blockchain.
+func TestStateChangeBlockChain(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db       = rawdb.NewMemoryDatabase()
+		key, _   = crypto.GenerateKey()
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		receiver = common.HexToAddress("0xdeadbeef")
+		coinbase = common.HexToAddress("0xc0ffee")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		gspec    = &core.Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   core.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+
+		// Contract storing 0x2a + block number at slot 0 on deployment
+		initCode = func(i int) []byte {
+			return []byte{byte(vm.PUSH1), byte(0x2a + i), byte(vm.PUSH1), 0x00, byte(vm.SSTORE), byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x00, byte(vm.RETURN)}
+		}
+		numberOfBlocks = 10
+	)
+	gspec.MustCommit(db)
+	blocks, _ := core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), gendb, numberOfBlocks, func(i int, gen *core.BlockGen) {
+		gen.SetCoinbase(coinbase)
+		tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(sender), receiver, big.NewInt(int64(1000+i)), params.TxGas, gen.BaseFee(), nil), signer, key)
+		gen.AddTx(tx)
+		if i%3 == 0 {
+			tx, _ = types.SignTx(types.NewContractCreation(gen.TxNonce(sender), new(big.Int), 100000, gen.BaseFee(), initCode(i)), signer, key)
+			gen.AddTx(tx)
+		}
+	})
+	chain, err := core.NewBlockChain(db, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	var (
+		backend  = &chainBackend{testBackend: &testBackend{db: db}, chain: chain}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		payloads = make(chan Payload, 4*numberOfBlocks)
+	)
+	sub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SkipSideChain: true}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		var payload Payload
+		select {
+		case payload = <-payloads:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for state diff of block %d", block.NumberU64())
+		}
+		if payload.BlockNumber != block.NumberU64() || payload.BlockHash != block.Hash() || payload.Status != CanonicalBlock {
+			t.Fatalf("payload mismatch: have %d %x %s, want %d %x %s", payload.BlockNumber, payload.BlockHash, payload.Status, block.NumberU64(), block.Hash(), CanonicalBlock)
+		}
+		if payload.Metadata[MetadataChainID] != params.TestChainConfig.ChainID.String() || payload.Metadata[MetadataServiceVersion] != params.VersionWithMeta {
+			t.Fatalf("block %d: payload metadata mismatch: have %v", block.NumberU64(), payload.Metadata)
+		}
+		stateDiff, err := DecodeStateDiff(payload)
+		if err != nil {
+			t.Fatalf("block %d: failed to decode state diff: %v", block.NumberU64(), err)
+		}
+		if stateDiff.BlockNumber.Uint64() != block.NumberU64() || stateDiff.BlockHash != block.Hash() {
+			t.Fatalf("block %d: state diff block mismatch: have %d %x", block.NumberU64(), stateDiff.BlockNumber, stateDiff.BlockHash)
+		}
+		// Every account touched by the block must be in the diff and match the committed state
+		want := map[common.Address]bool{sender: true, receiver: true, coinbase: true}
+		if (block.NumberU64()-1)%3 == 0 {
+			want[crypto.CreateAddress(sender, block.Transactions()[1].Nonce())] = true
+		}
+		statedb, err := chain.StateAt(block.Root())
+		if err != nil {
+			t.Fatalf("block %d: failed to open state: %v", block.NumberU64(), err)
+		}
+		if stateDiff.AccountCount() != len(want) {
+			t.Errorf("block %d: account count mismatch: have %d, want %d", block.NumberU64(), stateDiff.AccountCount(), len(want))
+		}
+		for _, diff := range stateDiff.UpdatedAccounts {
+			addr := common.BytesToAddress(diff.Key)
+			if !want[addr] {
+				t.Errorf("block %d: unexpected account %x in diff", block.NumberU64(), addr)
+				continue
+			}
+			account := diff.Account
+			if account.Nonce != statedb.GetNonce(addr) || account.Balance.Cmp(statedb.GetBalance(addr)) != 0 ||
+				account.Root != statedb.StorageTrie(addr).Hash() || common.BytesToHash(account.CodeHash) != statedb.GetCodeHash(addr) {
+				t.Errorf("block %d: account %x mismatch with committed state", block.NumberU64(), addr)
+			}
+			for _, storage := range diff.Storage {
+				var value []byte
+				if err := rlp.DecodeBytes(storage.Value, &value); err != nil {
+					t.Fatalf("block %d: failed to decode storage value: %v", block.NumberU64(), err)
+				}
+				slot := common.BytesToHash(storage.Key)
+				if have, want := common.BytesToHash(value), statedb.GetState(addr, slot); have != want {
+					t.Errorf("block %d: account %x slot %x mismatch: have %x, want %x", block.NumberU64(), addr, slot, have, want)
+				}
+			}
+		}
+		if stateDiff.StorageChangeCount() != len(want)-3 {
+			t.Errorf("block %d: storage change count mismatch: have %d, want %d", block.NumberU64(), stateDiff.StorageChangeCount(), len(want)-3)
+		}
+	}
+}
+
+// TestStateChangeReorg tests that a reorg reverting previously delivered state
+// diffs is announced, listing the reverted blocks most recent first, before the
+// diffs of the new canonical blocks are delivered.
+func TestStateChangeReorg(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		gspec   = &core.Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	gspec.MustCommit(db)
+	// Fork a longer chain off the second block, reverting the last three blocks
+	oldChain, _ := core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), gendb, 5, func(i int, gen *core.BlockGen) {
+		gen.SetCoinbase(common.HexToAddress("0xc0ffee"))
+	})
+	newChain, _ := core.GenerateChain(params.TestChainConfig, oldChain[1], ethash.NewFaker(), gendb, 4, func(i int, gen *core.BlockGen) {
+		gen.SetCoinbase(common.HexToAddress("0xcafebabe"))
+	})
+	chain, err := core.NewBlockChain(db, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	var (
+		backend  = &chainBackend{testBackend: &testBackend{db: db}, chain: chain}
+		api      = NewPublicFilterAPI(backend, false, deadline)
+		payloads = make(chan Payload, 20)
+	)
+	sub, err := api.events.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{SkipSideChain: true}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	next := func() Payload {
+		select {
+		case payload := <-payloads:
+			return payload
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for state diff")
+		}
+		return Payload{}
+	}
+	if _, err := chain.InsertChain(oldChain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range oldChain {
+		if payload := next(); payload.BlockHash != block.Hash() || payload.Status != CanonicalBlock {
+			t.Fatalf("payload mismatch: have %x %s, want %x %s", payload.BlockHash, payload.Status, block.Hash(), CanonicalBlock)
+		}
+	}
+	if _, err := chain.InsertChain(newChain); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	reorg := next()
+	if !reorg.IsReorg || reorg.BlockHash != oldChain[1].Hash() || reorg.BlockNumber != oldChain[1].NumberU64() {
+		t.Fatalf("reorg mismatch: have %v %d %x, want reorg to %d %x", reorg.IsReorg, reorg.BlockNumber, reorg.BlockHash, oldChain[1].NumberU64(), oldChain[1].Hash())
+	}
+	reverted := []common.Hash{oldChain[4].Hash(), oldChain[3].Hash(), oldChain[2].Hash()}
+	if !reflect.DeepEqual(reorg.RevertedHashes, reverted) {
+		t.Fatalf("reverted hashes mismatch: have %x, want %x", reorg.RevertedHashes, reverted)
+	}
+	for _, block := range newChain {
+		payload := next()
+		if payload.BlockHash != block.Hash() || payload.Status != CanonicalBlock || payload.IsReorg {
+			t.Fatalf("payload mismatch: have %d %x %s, want %d %x %s", payload.BlockNumber, payload.BlockHash, payload.Status, block.NumberU64(), block.Hash(), CanonicalBlock)
+		}
+	}
+}
+
+// TestStateChangeUntrackedReorg tests that a reorg whose fork point is older
+// than the tracked blocks restarts tracking from the new head, so that later
+// reorgs are announced again.
+func TestStateChangeUntrackedReorg(t *testing.T) {
+	t.Parallel()
+
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		backend   = &testBackend{db: db}
+		es        = NewEventSystem(backend, false)
+		genesis   = (&core.Genesis{BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+		chainA, _ = core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 3, func(i int, gen *core.BlockGen) {})
+		chainB, _ = core.GenerateChain(params.TestChainConfig, chainA[0], ethash.NewFaker(), db, 2, func(i int, gen *core.BlockGen) {
+			gen.SetCoinbase(common.HexToAddress("0xdeadbeef"))
+		})
+		chainC, _ = core.GenerateChain(params.TestChainConfig, chainB[0], ethash.NewFaker(), db, 2, func(i int, gen *core.BlockGen) {
+			gen.SetCoinbase(common.HexToAddress("0xcafebabe"))
+		})
+	)
+	setHead := func(blocks ...*types.Block) {
+		for _, block := range blocks {
+			rawdb.WriteBlock(db, block)
+			rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		}
+		head := blocks[len(blocks)-1]
+		backend.chainFeed.Send(core.ChainEvent{Block: head, Hash: head.Hash()})
+	}
+	payloads := make(chan Payload, 4)
+	sub, err := es.SubscribeStateChanges(ethereum.FilterQuery{}, StateChangeOptions{}, payloads)
+	if err != nil {
+		t.Fatalf("failed to subscribe to state changes: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Only the head of the first chain is tracked, the fork point of the same
+	// height reorg to the second chain is unknown
+	setHead(chainA...)
+	setHead(chainB...)
+	// The reorg to the third chain forks off the second one and must be announced
+	setHead(chainC...)
+
+	select {
+	case reorg := <-payloads:
+		if !reorg.IsReorg || reorg.BlockHash != chainB[0].Hash() {
+			t.Fatalf("reorg mismatch: have %v %d %x, want reorg to %d %x", reorg.IsReorg, reorg.BlockNumber, reorg.BlockHash, chainB[0].NumberU64(), chainB[0].Hash())
+		}
+		if reverted := []common.Hash{chainB[1].Hash()}; !reflect.DeepEqual(reorg.RevertedHashes, reverted) {
+			t.Fatalf("reverted hashes mismatch: have %x, want %x", reorg.RevertedHashes, reverted)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for reorg")
+	}
+}
+
+func TestBlockRing(t *testing.T) {
+	ring := newBlockRing(4)
+	for i := uint64(1); i <= 6; i++ {
+		ring.push(blockRef{hash: common.Hash{byte(i)}, number: i})
+	}
+	if last, ok := ring.last(); !ok || last.number != 6 {
+		t.Fatalf("last block mismatch: have %d, want 6", last.number)
+	}
+	if ring.contains(blockRef{hash: common.Hash{2}, number: 2}) {
+		t.Fatal("overwritten block still tracked")
+	}
+	if !ring.contains(blockRef{hash: common.Hash{3}, number: 3}) {
+		t.Fatal("oldest block not tracked")
+	}
+	removed := ring.truncate(3)
+	if len(removed) != 3 || removed[0].number != 6 || removed[1].number != 5 || removed[2].number != 4 {
+		t.Fatalf("truncated blocks mismatch: have %v", removed)
+	}
+	if last, _ := ring.last(); last.number != 3 {
+		t.Fatalf("last block after truncation mismatch: have %d, want 3", last.number)
+	}
+}
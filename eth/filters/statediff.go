@@ -1,20 +1,134 @@
 package filters
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
 	"math/big"
 	"reflect"
+	"sort"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 var emptyPayload Payload
 
+// StateDiffEncodingVersion is the version of the StateDiff encoding produced by
+// this package. It is bumped with every breaking change of the schema.
+// Version 2 added the block size.
+const StateDiffEncodingVersion uint8 = 2
+
+// SupportedVersions lists the StateDiff encoding versions DecodeStateDiff can decode.
+var SupportedVersions = []uint8{1, 2}
+
+// ErrUnsupportedVersion is returned when decoding a state diff of an unknown
+// encoding version.
+var ErrUnsupportedVersion = errors.New("unsupported state diff encoding version")
+
+var (
+	errLightStateChangesNoAddresses = errors.New("state change subscriptions require a list of addresses in light mode")
+	errLightStateUnavailable        = errors.New("backend does not support state retrieval")
+)
+
+// lightStateBackend is implemented by backends that can retrieve the state of
+// an arbitrary block, e.g. the light client backend which retrieves (and
+// verifies) the required account proofs on demand through ODR.
+type lightStateBackend interface {
+	StateAndHeaderByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*state.StateDB, *types.Header, error)
+}
+
+// chainConfigBackend is implemented by backends that expose the chain
+// configuration, used to annotate payloads with the chain ID.
+type chainConfigBackend interface {
+	ChainConfig() *params.ChainConfig
+}
+
+// Keys of the metadata annotations set on every payload.
+const (
+	MetadataChainID        = "chainID"
+	MetadataServiceVersion = "serviceVersion"
+)
+
+// payloadMetadata assembles the metadata annotations of the payloads sent by
+// the given backend.
+func payloadMetadata(backend Backend) map[string]string {
+	metadata := map[string]string{MetadataServiceVersion: params.VersionWithMeta}
+	if backend, ok := backend.(chainConfigBackend); ok {
+		if config := backend.ChainConfig(); config != nil && config.ChainID != nil {
+			metadata[MetadataChainID] = config.ChainID.String()
+		}
+	}
+	return metadata
+}
+
+// BlockStatus describes the position of the block a payload was built for
+// relative to the canonical chain.
+type BlockStatus string
+
+const (
+	// CanonicalBlock is a block that is part of the canonical chain.
+	CanonicalBlock BlockStatus = "canonical"
+	// PendingBlock is a block that was not (yet) part of the canonical chain
+	// when its state changes were processed. Once its final status is known a
+	// confirmation is sent.
+	PendingBlock BlockStatus = "pending"
+	// SideBlock is a block that did not become part of the canonical chain.
+	SideBlock BlockStatus = "side"
+)
+
+// StateChangeOptions are the optional parameters of a state change subscription.
+type StateChangeOptions struct {
+	// SkipSideChain withholds the payloads of pending blocks until they became
+	// canonical, so that no side chain payloads are ever delivered.
+	SkipSideChain bool `json:"skipSideChain"`
+	// SendRecent is the number of payloads of recent blocks sent right after
+	// subscribing, to catch up without a backfill. Blocks not yet canonical are
+	// sent as pending and confirmed later on. Only the last 16 blocks are kept,
+	// and none in light mode.
+	SendRecent int `json:"sendRecent"`
+}
+
 // processStateChanges builds the state diff Payload from the modified accounts in the StateChangeEvent
 func processStateChanges(event core.StateChangeEvent, crit ethereum.FilterQuery) (Payload, error) {
+	stateDiff, err := buildStateDiff(event, crit)
+	if err != nil || stateDiff == nil {
+		return emptyPayload, err
+	}
+
+	stateDiffRlp, err := rlp.EncodeToBytes(stateDiff)
+	if err != nil {
+		return emptyPayload, err
+	}
+	payload := Payload{
+		BlockNumber:     event.Block.NumberU64(),
+		BlockHash:       event.Block.Hash(),
+		StateDiffRlp:    stateDiffRlp,
+		EncodingVersion: StateDiffEncodingVersion,
+	}
+	// Difficulty is only meaningful before the merge, it is zero afterwards
+	if difficulty := event.Block.Difficulty(); difficulty.Sign() > 0 {
+		payload.Difficulty = difficulty
+	}
+
+	return payload, nil
+}
+
+// buildStateDiff builds the (unencoded) StateDiff from the modified accounts in
+// the StateChangeEvent matching the given criteria. It returns nil if no account
+// matched.
+func buildStateDiff(event core.StateChangeEvent, crit ethereum.FilterQuery) (*StateDiff, error) {
 	var accountDiffs []AccountDiff
 	block := event.Block
 	// Iterate over state changes to build AccountDiffs
@@ -25,42 +139,78 @@ func processStateChanges(event core.StateChangeEvent, crit ethereum.FilterQuery)
 
 		a, err := buildAccountDiff(addr, modifiedAccount)
 		if err != nil {
-			return emptyPayload, err
+			return nil, err
 		}
 
 		accountDiffs = append(accountDiffs, a)
 	}
 
 	if len(accountDiffs) == 0 {
-		return emptyPayload, nil
+		return nil, nil
 	}
 
-	stateDiff := StateDiff{
+	return &StateDiff{
 		BlockNumber:     block.Number(),
 		BlockHash:       block.Hash(),
 		UpdatedAccounts: accountDiffs,
-	}
+		BlockSize:       uint64(block.Size()),
+	}, nil
+}
 
-	stateDiffRlp, err := rlp.EncodeToBytes(stateDiff)
+// lightStateChanges reconstructs the state changes of the given header for the
+// watched addresses by comparing their accounts in the pre- and post-block state.
+// Only account level changes can be detected this way, storage diffs are not
+// reconstructed.
+func lightStateChanges(ctx context.Context, backend lightStateBackend, header *types.Header, addresses []common.Address) (state.StateChanges, error) {
+	parent, _, err := backend.StateAndHeaderByNumberOrHash(ctx, rpc.BlockNumberOrHashWithHash(header.ParentHash, false))
 	if err != nil {
-		return emptyPayload, err
+		return nil, err
 	}
-	payload := Payload{
-		StateDiffRlp: stateDiffRlp,
+	current, _, err := backend.StateAndHeaderByNumberOrHash(ctx, rpc.BlockNumberOrHashWithHash(header.Hash(), false))
+	if err != nil {
+		return nil, err
 	}
+	stateChanges := make(state.StateChanges)
+	for _, addr := range addresses {
+		prev, post := lightAccount(parent, addr), lightAccount(current, addr)
+		// Proofs failing verification surface as database errors on the state
+		if err := parent.Error(); err != nil {
+			return nil, err
+		}
+		if err := current.Error(); err != nil {
+			return nil, err
+		}
+		if prev.Nonce == post.Nonce && prev.Balance.Cmp(post.Balance) == 0 && prev.Root == post.Root && bytes.Equal(prev.CodeHash, post.CodeHash) {
+			continue
+		}
+		stateChanges[addr] = state.ModifiedAccount{StateAccount: post}
+	}
+	return stateChanges, nil
+}
 
-	return payload, nil
+// lightAccount retrieves the account of addr from the given state, returning
+// an empty account if it does not exist.
+func lightAccount(statedb *state.StateDB, addr common.Address) types.StateAccount {
+	if !statedb.Exist(addr) {
+		return types.StateAccount{Balance: new(big.Int)}
+	}
+	return types.StateAccount{
+		Nonce:    statedb.GetNonce(addr),
+		Balance:  statedb.GetBalance(addr),
+		Root:     statedb.StorageTrie(addr).Hash(),
+		CodeHash: statedb.GetCodeHash(addr).Bytes(),
+	}
 }
 
 // buildAccountDiff
 func buildAccountDiff(addr common.Address, modifiedAccount state.ModifiedAccount) (AccountDiff, error) {
 	emptyAccountDiff := AccountDiff{}
-	accountBytes, err := rlp.EncodeToBytes(&modifiedAccount.StateAccount)
-	if err != nil {
-		return emptyAccountDiff, err
-	}
+	account := modifiedAccount.StateAccount
 
-	var storageDiffs []StorageDiff
+	var storageDiffs map[string]StorageDiff
+	if len(modifiedAccount.Storage) > 0 {
+		storageDiffs = make(map[string]StorageDiff, len(modifiedAccount.Storage))
+	}
 	for k, v := range modifiedAccount.Storage {
 		// Storage diff value should be an RLP object too
 		encodedValueRlp, err := rlp.EncodeToBytes(v[:])
@@ -72,38 +222,243 @@ func buildAccountDiff(addr common.Address, modifiedAccount state.ModifiedAccount
 			Key:   storageKey[:],
 			Value: encodedValueRlp,
 		}
-		storageDiffs = append(storageDiffs, diff)
+		storageDiffs[StorageDiffKey(storageKey[:])] = diff
 	}
 
 	address := addr
 	return AccountDiff{
 		Key:     address[:],
-		Value:   accountBytes,
+		Account: &account,
 		Storage: storageDiffs,
 	}, nil
 }
 
+// stateChangeConfirmation builds the payload confirming the final status of a
+// previously pending block. It carries a state diff without any accounts.
+func stateChangeConfirmation(hash common.Hash, number uint64, status BlockStatus) (Payload, error) {
+	stateDiffRlp, err := rlp.EncodeToBytes(StateDiff{
+		BlockNumber: new(big.Int).SetUint64(number),
+		BlockHash:   hash,
+	})
+	if err != nil {
+		return emptyPayload, err
+	}
+	return Payload{BlockNumber: number, BlockHash: hash, StateDiffRlp: stateDiffRlp, EncodingVersion: StateDiffEncodingVersion, Status: status}, nil
+}
+
+// stateChangeReorg builds the payload announcing that the given blocks, most
+// recent first, were reverted back to the common ancestor.
+func stateChangeReorg(ancestor common.Hash, number uint64, reverted []common.Hash) (Payload, error) {
+	payload, err := stateChangeConfirmation(ancestor, number, CanonicalBlock)
+	if err != nil {
+		return emptyPayload, err
+	}
+	payload.IsReorg, payload.RevertedHashes = true, reverted
+	return payload, nil
+}
+
+// DecodeStateDiff decodes the state diff carried by the given payload. It returns
+// ErrUnsupportedVersion if the payload was encoded with a version not listed in
+// SupportedVersions.
+func DecodeStateDiff(payload Payload) (*StateDiff, error) {
+	supported := false
+	for _, version := range SupportedVersions {
+		if payload.EncodingVersion == version {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, payload.EncodingVersion)
+	}
+	stateDiff := new(StateDiff)
+	if err := rlp.DecodeBytes(payload.StateDiffRlp, stateDiff); err != nil {
+		return nil, err
+	}
+	return stateDiff, nil
+}
+
+// payloadSigningData is the RLP encoded content of a payload covered by its
+// signature, which is every field but the signature itself. Metadata is encoded
+// as a list sorted by key.
+type payloadSigningData struct {
+	BlockNumber     uint64
+	BlockHash       common.Hash
+	StateDiffRlp    []byte
+	EncodingVersion uint8
+	Difficulty      *big.Int
+	Status          BlockStatus
+	IsReorg         bool
+	RevertedHashes  []common.Hash
+	Metadata        []metadataEntry
+	Err             string
+}
+
+type metadataEntry struct {
+	Key, Value string
+}
+
+// payloadSigningHash returns the hash signed by SignPayload.
+func payloadSigningHash(payload Payload) ([]byte, error) {
+	metadata := make([]metadataEntry, 0, len(payload.Metadata))
+	for k, v := range payload.Metadata {
+		metadata = append(metadata, metadataEntry{k, v})
+	}
+	sort.Slice(metadata, func(i, j int) bool { return metadata[i].Key < metadata[j].Key })
+
+	enc, err := rlp.EncodeToBytes(&payloadSigningData{
+		BlockNumber:     payload.BlockNumber,
+		BlockHash:       payload.BlockHash,
+		StateDiffRlp:    payload.StateDiffRlp,
+		EncodingVersion: payload.EncodingVersion,
+		Difficulty:      payload.Difficulty,
+		Status:          payload.Status,
+		IsReorg:         payload.IsReorg,
+		RevertedHashes:  payload.RevertedHashes,
+		Metadata:        metadata,
+		Err:             payload.Err,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(enc), nil
+}
+
+// SignPayload signs all fields of the payload with the given node key, storing
+// the 65 byte signature in NodeSignature so consumers receiving the payload over
+// untrusted channels can authenticate its origin.
+func SignPayload(payload *Payload, key *ecdsa.PrivateKey) error {
+	hash, err := payloadSigningHash(*payload)
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return err
+	}
+	payload.NodeSignature = sig
+	return nil
+}
+
+// VerifyPayloadSignature reports whether the node signature of the payload was
+// made by the owner of the given public key.
+func VerifyPayloadSignature(payload Payload, pubkey *ecdsa.PublicKey) bool {
+	if len(payload.NodeSignature) != crypto.SignatureLength || pubkey == nil {
+		return false
+	}
+	hash, err := payloadSigningHash(payload)
+	if err != nil {
+		return false
+	}
+	return crypto.VerifySignature(crypto.FromECDSAPub(pubkey), hash, payload.NodeSignature[:crypto.RecoveryIDOffset])
+}
+
 func isPayloadEmpty(payload Payload) bool {
 	return reflect.DeepEqual(payload, emptyPayload)
 }
 
-// Payload packages the data to send to statediff subscriptions
+// Payload packages the data to send to statediff subscriptions. A payload whose
+// state diff holds no accounts confirms the final status of a block previously
+// sent as pending.
+//
+// Subscribers must check IsReorg before applying a payload: a reorg payload
+// carries no state changes, it announces that the diffs of the blocks listed in
+// RevertedHashes (most recent first) were reverted, and that the chain continues
+// from the common ancestor identified by the block number and hash.
 type Payload struct {
-	StateDiffRlp []byte `json:"stateDiff"    gencodec:"required"`
+	// Block number and hash duplicated outside of the encoded state diff, so
+	// payloads can be routed without decoding them
+	BlockNumber uint64      `json:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash"`
+
+	StateDiffRlp    []byte `json:"stateDiff"    gencodec:"required"`
+	EncodingVersion uint8  `json:"encodingVersion"` // Encoding version of the state diff, checked by DecodeStateDiff
+
+	Difficulty     *big.Int          `json:"difficulty,omitempty"` // Difficulty of pre-merge blocks, nil for post-merge ones
+	Status         BlockStatus       `json:"status"`
+	IsReorg        bool              `json:"isReorg,omitempty"`
+	RevertedHashes []common.Hash     `json:"revertedHashes,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"` // Routing annotations such as the chain ID and node version
+	Err            string            `json:"error,omitempty"`
+	NodeSignature  []byte            `json:"nodeSignature,omitempty"` // Signature of all other fields, set by SignPayload
 }
 
-// StateDiff is the final output structure from the builder
+// StateDiff is the final output structure from the builder. BlockSize is the
+// RLP encoded size of the block, it is absent from version 1 encodings.
 type StateDiff struct {
 	BlockNumber     *big.Int      `json:"blockNumber"     gencodec:"required"`
 	BlockHash       common.Hash   `json:"blockHash"       gencodec:"required"`
 	UpdatedAccounts []AccountDiff `json:"updatedAccounts" gencodec:"required"`
+	BlockSize       uint64        `json:"blockSize"       rlp:"optional"`
+}
+
+// AccountCount returns the number of distinct accounts changed in the state diff.
+func (sd *StateDiff) AccountCount() int {
+	accounts := make(map[string]struct{}, len(sd.UpdatedAccounts))
+	for _, account := range sd.UpdatedAccounts {
+		accounts[string(account.Key)] = struct{}{}
+	}
+	return len(accounts)
 }
 
-// AccountDiff holds the data for a single state diff node
+// StorageChangeCount returns the total number of storage slots changed across
+// all accounts of the state diff.
+func (sd *StateDiff) StorageChangeCount() int {
+	var count int
+	for _, account := range sd.UpdatedAccounts {
+		count += len(account.Storage)
+	}
+	return count
+}
+
+// AccountDiff holds the data for a single state diff node. Its storage diffs are
+// keyed by StorageDiffKey.
 type AccountDiff struct {
-	Key     []byte        `json:"key"         gencodec:"required"`
-	Value   []byte        `json:"value"       gencodec:"required"`
-	Storage []StorageDiff `json:"storage"     gencodec:"required"`
+	Key     []byte                 `json:"key"         gencodec:"required"`
+	Account *types.StateAccount    `json:"account"     gencodec:"required"`
+	Storage map[string]StorageDiff `json:"storage"     gencodec:"required"`
+}
+
+// accountDiffRLP is the RLP encoding of AccountDiff, which holds the storage diffs
+// as a list sorted by key.
+type accountDiffRLP struct {
+	Key     []byte
+	Account *types.StateAccount
+	Storage []StorageDiff
+}
+
+// StorageDiffKey returns the key of the given storage slot in AccountDiff.Storage,
+// which is its hex encoding.
+func StorageDiffKey(slot []byte) string {
+	return hexutil.Encode(slot)
+}
+
+// EncodeRLP implements rlp.Encoder.
+func (ad *AccountDiff) EncodeRLP(w io.Writer) error {
+	storage := make([]StorageDiff, 0, len(ad.Storage))
+	for _, diff := range ad.Storage {
+		storage = append(storage, diff)
+	}
+	sort.Slice(storage, func(i, j int) bool {
+		return bytes.Compare(storage[i].Key, storage[j].Key) < 0
+	})
+	return rlp.Encode(w, &accountDiffRLP{Key: ad.Key, Account: ad.Account, Storage: storage})
+}
+
+// DecodeRLP implements rlp.Decoder.
+func (ad *AccountDiff) DecodeRLP(s *rlp.Stream) error {
+	var dec accountDiffRLP
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+	ad.Key, ad.Account, ad.Storage = dec.Key, dec.Account, nil
+	if len(dec.Storage) > 0 {
+		ad.Storage = make(map[string]StorageDiff, len(dec.Storage))
+		for _, diff := range dec.Storage {
+			ad.Storage[StorageDiffKey(diff.Key)] = diff
+		}
+	}
+	return nil
 }
 
 // StorageDiff holds the data for a single storage diff node
@@ -111,3 +466,15 @@ type StorageDiff struct {
 	Key   []byte `json:"key"         gencodec:"required"`
 	Value []byte `json:"value"       gencodec:"required"`
 }
+
+// IsZero returns whether the storage slot was set to zero, i.e. deleted. The
+// value is accepted both as a raw 32 byte word and in its RLP encoded form.
+func (sd StorageDiff) IsZero() bool {
+	value := sd.Value
+	if len(value) != 0 && len(value) != common.HashLength {
+		if err := rlp.DecodeBytes(sd.Value, &value); err != nil || len(value) > common.HashLength {
+			return false
+		}
+	}
+	return common.BytesToHash(value) == (common.Hash{})
+}
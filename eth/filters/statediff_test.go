@@ -0,0 +1,439 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestBuildStateDiff(t *testing.T) {
+	var (
+		addr1 = common.HexToAddress("0x1")
+		addr2 = common.HexToAddress("0x2")
+		block = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+		event = core.StateChangeEvent{
+			Block: block,
+			StateChanges: state.StateChanges{
+				addr1: state.ModifiedAccount{StateAccount: types.StateAccount{Balance: big.NewInt(1)}},
+				addr2: state.ModifiedAccount{
+					StateAccount: types.StateAccount{Balance: big.NewInt(2)},
+					Storage:      state.Storage{common.HexToHash("0x1"): common.HexToHash("0x2")},
+				},
+			},
+		}
+	)
+	stateDiff, err := buildStateDiff(event, ethereum.FilterQuery{Addresses: []common.Address{addr2}})
+	if err != nil {
+		t.Fatalf("failed to build state diff: %v", err)
+	}
+	if stateDiff.BlockHash != block.Hash() || stateDiff.BlockNumber.Cmp(block.Number()) != 0 {
+		t.Errorf("block mismatch: have %v %x, want %v %x", stateDiff.BlockNumber, stateDiff.BlockHash, block.Number(), block.Hash())
+	}
+	if stateDiff.BlockSize != uint64(block.Size()) {
+		t.Errorf("block size mismatch: have %d, want %d", stateDiff.BlockSize, uint64(block.Size()))
+	}
+	if stateDiff.AccountCount() != 1 || stateDiff.StorageChangeCount() != 1 {
+		t.Errorf("diff size mismatch: have %d accounts %d slots, want 1 and 1", stateDiff.AccountCount(), stateDiff.StorageChangeCount())
+	}
+	// The encoded payload must match the typed diff
+	payload, err := processStateChanges(event, ethereum.FilterQuery{Addresses: []common.Address{addr2}})
+	if err != nil {
+		t.Fatalf("failed to process state changes: %v", err)
+	}
+	want, _ := rlp.EncodeToBytes(stateDiff)
+	if !bytes.Equal(payload.StateDiffRlp, want) {
+		t.Errorf("encoded state diff mismatch: have %x, want %x", payload.StateDiffRlp, want)
+	}
+	// No diff is built if no account matches
+	if stateDiff, err = buildStateDiff(event, ethereum.FilterQuery{Addresses: []common.Address{common.HexToAddress("0x3")}}); stateDiff != nil || err != nil {
+		t.Errorf("unexpected state diff for unwatched addresses: %v %v", stateDiff, err)
+	}
+}
+
+func TestPayloadDifficulty(t *testing.T) {
+	changes := state.StateChanges{common.HexToAddress("0x1"): state.ModifiedAccount{StateAccount: types.StateAccount{Balance: big.NewInt(1)}}}
+	tests := []struct {
+		difficulty *big.Int
+		want       *big.Int
+		json       string
+	}{
+		{big.NewInt(131072), big.NewInt(131072), `"difficulty":131072`},
+		{big.NewInt(0), nil, ""},
+		{nil, nil, ""},
+	}
+	for i, tt := range tests {
+		block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Difficulty: tt.difficulty})
+		payload, err := processStateChanges(core.StateChangeEvent{Block: block, StateChanges: changes}, ethereum.FilterQuery{})
+		if err != nil {
+			t.Fatalf("test %d: failed to process state changes: %v", i, err)
+		}
+		if (payload.Difficulty == nil) != (tt.want == nil) || (tt.want != nil && payload.Difficulty.Cmp(tt.want) != 0) {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, payload.Difficulty, tt.want)
+		}
+		enc, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode payload: %v", i, err)
+		}
+		if have := bytes.Contains(enc, []byte(`"difficulty"`)); have != (tt.json != "") || !bytes.Contains(enc, []byte(tt.json)) {
+			t.Errorf("test %d: unexpected JSON encoding %s", i, enc)
+		}
+		var dec Payload
+		if err := json.Unmarshal(enc, &dec); err != nil {
+			t.Fatalf("test %d: failed to decode payload: %v", i, err)
+		}
+		if (dec.Difficulty == nil) != (tt.want == nil) || (tt.want != nil && dec.Difficulty.Cmp(tt.want) != 0) {
+			t.Errorf("test %d: decoded difficulty mismatch: have %v, want %v", i, dec.Difficulty, tt.want)
+		}
+	}
+}
+
+func TestStorageDiffIsZero(t *testing.T) {
+	encode := func(v interface{}) []byte {
+		enc, err := rlp.EncodeToBytes(v)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", v, err)
+		}
+		return enc
+	}
+	tests := []struct {
+		value []byte
+		zero  bool
+	}{
+		{nil, true},
+		{[]byte{}, true},
+		{make([]byte, common.HashLength), true},
+		{encode(make([]byte, common.HashLength)), true},
+		{encode(uint64(0)), true},
+		{encode([]byte{0}), true},
+		{common.HexToHash("0x01").Bytes(), false},
+		{encode(common.HexToHash("0x01").Bytes()), false},
+		{encode(uint64(1)), false},
+		{encode(make([]byte, common.HashLength+1)), false},
+		{[]byte{0xc0, 0x01}, false},
+	}
+	for i, test := range tests {
+		if have := (StorageDiff{Value: test.value}).IsZero(); have != test.zero {
+			t.Errorf("test %d: IsZero mismatch for %x: have %v, want %v", i, test.value, have, test.zero)
+		}
+	}
+}
+
+func TestStateDiffCounts(t *testing.T) {
+	var (
+		addr1 = common.HexToAddress("0x1")
+		addr2 = common.HexToAddress("0x2")
+		slot1 = StorageDiff{Key: common.HexToHash("0x1").Bytes()}
+		slot2 = StorageDiff{Key: common.HexToHash("0x2").Bytes()}
+	)
+	tests := []struct {
+		accounts []AccountDiff
+		count    int
+		slots    int
+	}{
+		{nil, 0, 0},
+		{[]AccountDiff{{Key: addr1[:]}}, 1, 0},
+		{[]AccountDiff{{Key: addr1[:], Storage: storageDiffs(slot1, slot2)}, {Key: addr2[:], Storage: storageDiffs(slot1)}}, 2, 3},
+		{[]AccountDiff{{Key: addr1[:], Storage: storageDiffs(slot1)}, {Key: addr1[:], Storage: storageDiffs(slot1)}}, 1, 2},
+	}
+	for i, test := range tests {
+		diff := StateDiff{UpdatedAccounts: test.accounts}
+		if have := diff.AccountCount(); have != test.count {
+			t.Errorf("test %d: account count mismatch: have %d, want %d", i, have, test.count)
+		}
+		if have := diff.StorageChangeCount(); have != test.slots {
+			t.Errorf("test %d: storage change count mismatch: have %d, want %d", i, have, test.slots)
+		}
+	}
+}
+
+func TestAccountDiffRLP(t *testing.T) {
+	var (
+		slot1 = StorageDiff{Key: common.HexToHash("0x1").Bytes(), Value: []byte{0x01}}
+		slot2 = StorageDiff{Key: common.HexToHash("0x2").Bytes(), Value: []byte{0x02}}
+		addr  = common.HexToAddress("0x1")
+		diff  = AccountDiff{
+			Key:     addr[:],
+			Account: &types.StateAccount{Nonce: 1, Balance: big.NewInt(2), Root: common.HexToHash("0x3"), CodeHash: []byte{0x04}},
+			Storage: storageDiffs(slot2, slot1),
+		}
+	)
+	enc, err := rlp.EncodeToBytes(&diff)
+	if err != nil {
+		t.Fatalf("failed to encode account diff: %v", err)
+	}
+	// Storage diffs are encoded as a key sorted list
+	want, _ := rlp.EncodeToBytes(&accountDiffRLP{Key: diff.Key, Account: diff.Account, Storage: []StorageDiff{slot1, slot2}})
+	if !bytes.Equal(enc, want) {
+		t.Fatalf("encoding mismatch: have %x, want %x", enc, want)
+	}
+	var dec AccountDiff
+	if err := rlp.DecodeBytes(enc, &dec); err != nil {
+		t.Fatalf("failed to decode account diff: %v", err)
+	}
+	if !reflect.DeepEqual(dec, diff) {
+		t.Errorf("decoded account diff mismatch: have %+v, want %+v", dec, diff)
+	}
+	if have := dec.Storage[StorageDiffKey(slot1.Key)]; !bytes.Equal(have.Value, slot1.Value) {
+		t.Errorf("storage lookup mismatch: have %x, want %x", have.Value, slot1.Value)
+	}
+}
+
+// storageDiffs groups the given storage diffs by key.
+func storageDiffs(diffs ...StorageDiff) map[string]StorageDiff {
+	storage := make(map[string]StorageDiff, len(diffs))
+	for _, diff := range diffs {
+		storage[StorageDiffKey(diff.Key)] = diff
+	}
+	return storage
+}
+
+// makeStateChangeEvent creates a state change event for the given block with the
+// given number of modified accounts, every tenth of them with storage changes.
+func makeStateChangeEvent(block *types.Block, accounts int) core.StateChangeEvent {
+	changes := make(state.StateChanges, accounts)
+	for i := 0; i < accounts; i++ {
+		account := state.ModifiedAccount{StateAccount: types.StateAccount{Nonce: uint64(i), Balance: big.NewInt(int64(i)), CodeHash: types.EmptyRootHash[:]}}
+		if i%10 == 0 {
+			account.Storage = make(state.Storage)
+			for j := 0; j < 10; j++ {
+				account.Storage[common.BigToHash(big.NewInt(int64(j)))] = common.BigToHash(big.NewInt(int64(i + j)))
+			}
+		}
+		changes[common.BigToAddress(big.NewInt(int64(i)))] = account
+	}
+	return core.StateChangeEvent{Block: block, StateChanges: changes}
+}
+
+func BenchmarkProcessStateChanges(b *testing.B) {
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	for _, accounts := range []int{100, 1000, 10000} {
+		event := makeStateChangeEvent(block, accounts)
+		b.Run(fmt.Sprintf("accounts-%d", accounts), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := processStateChanges(event, ethereum.FilterQuery{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		es    = NewEventSystem(&testBackend{db: db}, false)
+		block = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+		event = makeStateChangeEvent(block, 100)
+	)
+	rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+
+	for _, subscribers := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("subscribers-%d", subscribers), func(b *testing.B) {
+			index := filterIndex{StateChangeSubscription: make(map[rpc.ID]*subscription)}
+			quit := make(chan struct{})
+			for i := 0; i < subscribers; i++ {
+				f := &subscription{id: rpc.NewID(), typ: StateChangeSubscription, stateChangePayloads: make(chan Payload)}
+				index[StateChangeSubscription][f.id] = f
+				go func() {
+					for {
+						select {
+						case <-f.stateChangePayloads:
+						case <-quit:
+							return
+						}
+					}
+				}()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				es.handleStateChangeEvent(index, event)
+			}
+			b.StopTimer()
+			close(quit)
+		})
+	}
+}
+
+// makeStateDiff creates a state diff with the given number of accounts, each
+// with the given number of changed storage slots.
+func makeStateDiff(accounts, slots int) *StateDiff {
+	diff := &StateDiff{BlockNumber: big.NewInt(1), BlockHash: common.Hash{1}}
+	for i := 0; i < accounts; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i)))
+		account := AccountDiff{
+			Key:     addr[:],
+			Account: &types.StateAccount{Nonce: uint64(i), Balance: big.NewInt(int64(i)), CodeHash: types.EmptyRootHash[:]},
+			Storage: make(map[string]StorageDiff, slots),
+		}
+		for j := 0; j < slots; j++ {
+			key, value := common.BigToHash(big.NewInt(int64(j))), common.BigToHash(big.NewInt(int64(i+j)))
+			enc, _ := rlp.EncodeToBytes(value[:])
+			account.Storage[StorageDiffKey(key[:])] = StorageDiff{Key: key[:], Value: enc}
+		}
+		diff.UpdatedAccounts = append(diff.UpdatedAccounts, account)
+	}
+	return diff
+}
+
+func BenchmarkEncodeStateDiffRLP(b *testing.B) {
+	benchmarkEncodeStateDiff(b, rlp.EncodeToBytes)
+}
+
+func BenchmarkEncodeStateDiffJSON(b *testing.B) {
+	benchmarkEncodeStateDiff(b, json.Marshal)
+}
+
+func BenchmarkDecodeStateDiffRLP(b *testing.B) {
+	benchmarkDecodeStateDiff(b, rlp.EncodeToBytes, rlp.DecodeBytes)
+}
+
+func BenchmarkDecodeStateDiffJSON(b *testing.B) {
+	benchmarkDecodeStateDiff(b, json.Marshal, json.Unmarshal)
+}
+
+func benchmarkEncodeStateDiff(b *testing.B, encode func(interface{}) ([]byte, error)) {
+	diff := makeStateDiff(500, 50)
+	enc, err := encode(diff)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encode(diff); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecodeStateDiff(b *testing.B, encode func(interface{}) ([]byte, error), decode func([]byte, interface{}) error) {
+	enc, err := encode(makeStateDiff(500, 50))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var diff StateDiff
+		if err := decode(enc, &diff); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeStateDiff(t *testing.T) {
+	payload, err := stateChangeConfirmation(common.Hash{1}, 1, CanonicalBlock)
+	if err != nil {
+		t.Fatalf("failed to build payload: %v", err)
+	}
+	if payload.EncodingVersion != StateDiffEncodingVersion {
+		t.Fatalf("encoding version mismatch: have %d, want %d", payload.EncodingVersion, StateDiffEncodingVersion)
+	}
+	stateDiff, err := DecodeStateDiff(payload)
+	if err != nil {
+		t.Fatalf("failed to decode state diff: %v", err)
+	}
+	if stateDiff.BlockHash != payload.BlockHash || stateDiff.BlockNumber.Uint64() != payload.BlockNumber {
+		t.Fatalf("state diff block mismatch: have %d %x", stateDiff.BlockNumber, stateDiff.BlockHash)
+	}
+	// Version 1 state diffs lack the block size
+	v1, err := rlp.EncodeToBytes([]interface{}{big.NewInt(1), common.Hash{1}, []AccountDiff{}})
+	if err != nil {
+		t.Fatalf("failed to encode version 1 state diff: %v", err)
+	}
+	if stateDiff, err = DecodeStateDiff(Payload{StateDiffRlp: v1, EncodingVersion: 1}); err != nil {
+		t.Fatalf("failed to decode version 1 state diff: %v", err)
+	}
+	if stateDiff.BlockHash != (common.Hash{1}) || stateDiff.BlockSize != 0 {
+		t.Fatalf("version 1 state diff mismatch: have %x %d", stateDiff.BlockHash, stateDiff.BlockSize)
+	}
+	for _, version := range []uint8{0, StateDiffEncodingVersion + 1} {
+		payload.EncodingVersion = version
+		if _, err := DecodeStateDiff(payload); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("version %d: error mismatch: have %v, want %v", version, err, ErrUnsupportedVersion)
+		}
+	}
+}
+
+func TestPayloadSignature(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+
+	payload, err := stateChangeReorg(common.Hash{1}, 1, []common.Hash{{3}, {2}})
+	if err != nil {
+		t.Fatalf("failed to build payload: %v", err)
+	}
+	payload.Difficulty = big.NewInt(131072)
+	payload.Metadata = map[string]string{MetadataChainID: "1", MetadataServiceVersion: "1.0.0"}
+
+	if VerifyPayloadSignature(payload, &key.PublicKey) {
+		t.Fatal("payload verified without signature")
+	}
+	if err := SignPayload(&payload, key); err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+	if len(payload.NodeSignature) != crypto.SignatureLength {
+		t.Fatalf("signature length mismatch: have %d, want %d", len(payload.NodeSignature), crypto.SignatureLength)
+	}
+	if !VerifyPayloadSignature(payload, &key.PublicKey) {
+		t.Fatal("signed payload not verified")
+	}
+	if VerifyPayloadSignature(payload, &other.PublicKey) {
+		t.Fatal("payload verified with the wrong key")
+	}
+	// The signature survives the JSON encoding of the payload
+	enc, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to encode payload: %v", err)
+	}
+	var decoded Payload
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if !VerifyPayloadSignature(decoded, &key.PublicKey) {
+		t.Fatal("decoded payload not verified")
+	}
+	// Tampering with any field must invalidate the signature
+	tampers := map[string]func(p *Payload){
+		"blockNumber":     func(p *Payload) { p.BlockNumber++ },
+		"blockHash":       func(p *Payload) { p.BlockHash = common.Hash{2} },
+		"stateDiff":       func(p *Payload) { p.StateDiffRlp = append(common.CopyBytes(p.StateDiffRlp), 0x80) },
+		"encodingVersion": func(p *Payload) { p.EncodingVersion++ },
+		"difficulty":      func(p *Payload) { p.Difficulty = big.NewInt(1) },
+		"status":          func(p *Payload) { p.Status = SideBlock },
+		"isReorg":         func(p *Payload) { p.IsReorg = false },
+		"revertedHashes":  func(p *Payload) { p.RevertedHashes = p.RevertedHashes[:1] },
+		"metadata":        func(p *Payload) { p.Metadata = map[string]string{MetadataChainID: "5"} },
+		"error":           func(p *Payload) { p.Err = "failed" },
+	}
+	for field, tamper := range tampers {
+		tampered := payload
+		tamper(&tampered)
+		if VerifyPayloadSignature(tampered, &key.PublicKey) {
+			t.Errorf("payload with tampered %s verified", field)
+		}
+	}
+	// Metadata iteration order must not affect the signature
+	payload.Metadata = map[string]string{MetadataServiceVersion: "1.0.0", MetadataChainID: "1"}
+	if !VerifyPayloadSignature(payload, &key.PublicKey) {
+		t.Fatal("payload with rebuilt metadata not verified")
+	}
+}
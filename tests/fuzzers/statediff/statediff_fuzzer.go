@@ -0,0 +1,62 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// decodeEncode decodes the input into val and checks that the re-encoding of
+// anything accepted is canonical, i.e. decodes again and encodes to the very
+// same bytes. The input itself need not round-trip, as storage diffs are
+// re-encoded in sorted order.
+func decodeEncode(input []byte, val, fresh interface{}, i int) int {
+	if err := rlp.DecodeBytes(input, val); err != nil {
+		return 0
+	}
+	output, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		panic(fmt.Sprintf("case %d: failed to encode decoded value: %v", i, err))
+	}
+	if err := rlp.DecodeBytes(output, fresh); err != nil {
+		panic(fmt.Sprintf("case %d: failed to decode re-encoded value: %v\noutput: %x", i, err, output))
+	}
+	again, err := rlp.EncodeToBytes(fresh)
+	if err != nil {
+		panic(fmt.Sprintf("case %d: failed to encode decoded value: %v", i, err))
+	}
+	if !bytes.Equal(output, again) {
+		panic(fmt.Sprintf("case %d: encoding is not canonical\nfirst : %x\nsecond: %x", i, output, again))
+	}
+	return 1
+}
+
+// Fuzz decodes the input as the state diff types delivered to subscribers.
+func Fuzz(input []byte) int {
+	if len(input) == 0 {
+		return 0
+	}
+	var res int
+	res |= decodeEncode(input, new(filters.StateDiff), new(filters.StateDiff), 0)
+	res |= decodeEncode(input, new(filters.AccountDiff), new(filters.AccountDiff), 1)
+	res |= decodeEncode(input, new(filters.StorageDiff), new(filters.StorageDiff), 2)
+	return res
+}